@@ -13,13 +13,22 @@ const (
 	HEADER_PROXY_FOR     = "X-Proxy-For"
 	HEADER_ORIGIN        = "Origin"
 	HEADER_FORWARD_FOR   = "X-Forwarded-For"
+	HEADER_FORWARD_PROTO = "X-Forwarded-Proto"
+	HEADER_FORWARD_HOST  = "X-Forwarded-Host"
+	HEADER_FORWARDED     = "Forwarded"
 	HEADER_REQUEST_ID    = "X-Webx-Request-Id"
 	HEADER_MESSAGE_LIMIT = "X-Webx-Message-Limit"
 	HEADER_CONTENT_LEN   = "Content-Length"
+	HEADER_STREAM        = "X-Webx-Stream"
+	HEADER_IDENTITY      = "X-Webx-Identity"
+	HEADER_TUNNEL        = "X-Webx-Tunnel"
 
 	SUB_PROTOCOL_WEBX  = "webx"
 	MESSAGE_LIMIT_BASE = 10
 	HUB_RESOURCE_NAME  = "/_webx"
+	HUB_TUNNEL_PATH    = "/tunnel" // under the hub resource, for plugs to dial tunnels
+
+	APP_VERSION = "0.1" // version of the webx programs
 )
 
 // Hop-by-hop headers in 13.5.1 of RFC2616
@@ -0,0 +1,42 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Compression of the plug link.
+//
+// Hubs and plugs negotiate per-message deflate (RFC 7692) when dialing.
+// Messages of bodies already compressed, like images or gzipped content,
+// are sent without it to save CPU on both ends.
+
+// media types not worth compressing again, by prefix
+var INCOMPRESSIBLE_TYPES = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/x-rar-compressed",
+	"application/grpc",
+}
+
+// whether a message with the headers is worth compressing
+func Compressible(h http.Header) bool {
+	if ce := h.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+	ct := strings.ToLower(h.Get("Content-Type"))
+	if ct == "image/svg+xml" || strings.HasPrefix(ct, "image/svg+xml;") {
+		return true
+	}
+	for _, t := range INCOMPRESSIBLE_TYPES {
+		if strings.HasPrefix(ct, t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// operations of header rules
+const (
+	HEADER_OP_ADD     = "add"     // add a value
+	HEADER_OP_SET     = "set"     // replace all values by one
+	HEADER_OP_DEFAULT = "default" // set if missing
+	HEADER_OP_REMOVE  = "remove"  // drop the header
+	HEADER_OP_REPLACE = "replace" // rewrite values matching a regexp
+)
+
+// HeaderRule changes one header of requests or responses
+type HeaderRule struct {
+	Op    string // one of HEADER_OP_*
+	Name  string // header name
+	Value string // value to add or set, or replacement with $1 style groups
+	Match string // regexp of values to replace
+
+	re *regexp.Regexp
+}
+
+// HeaderRules of a vhost, applied in order
+type HeaderRules struct {
+	Request  []*HeaderRule // rules for requests to the real host
+	Response []*HeaderRule // rules for responses to visitors
+	// add common security headers to responses missing them,
+	// before the response rules
+	Security bool
+}
+
+// security headers added by HeaderRules.Security
+var SECURITY_HEADERS = [][2]string{
+	{"Strict-Transport-Security", "max-age=31536000"},
+	{"X-Frame-Options", "SAMEORIGIN"},
+	{"X-Content-Type-Options", "nosniff"},
+	{"Referrer-Policy", "strict-origin-when-cross-origin"},
+}
+
+// check and prepare the rules, should be called once after loading
+func (hr *HeaderRules) Compile() error {
+	if hr.Security {
+		var sec []*HeaderRule
+		for _, kv := range SECURITY_HEADERS {
+			sec = append(sec, &HeaderRule{Op: HEADER_OP_DEFAULT, Name: kv[0], Value: kv[1]})
+		}
+		hr.Response = append(sec, hr.Response...)
+		hr.Security = false
+	}
+	for _, rules := range [][]*HeaderRule{hr.Request, hr.Response} {
+		for _, r := range rules {
+			if r == nil || r.Name == "" {
+				return errors.New("header rule without name")
+			}
+			r.Op = strings.ToLower(r.Op)
+			switch r.Op {
+			case HEADER_OP_ADD, HEADER_OP_SET, HEADER_OP_DEFAULT, HEADER_OP_REMOVE:
+			case HEADER_OP_REPLACE:
+				re, err := regexp.Compile(r.Match)
+				if err != nil || r.Match == "" {
+					return errors.New("bad header match for " + r.Name + ": " + r.Match)
+				}
+				r.re = re
+			default:
+				return errors.New("bad header op for " + r.Name + ": " + r.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// apply compiled rules to the headers
+func ApplyHeaderRules(rules []*HeaderRule, h http.Header) {
+	for _, r := range rules {
+		switch r.Op {
+		case HEADER_OP_ADD:
+			h.Add(r.Name, r.Value)
+		case HEADER_OP_SET:
+			h.Set(r.Name, r.Value)
+		case HEADER_OP_DEFAULT:
+			if h.Get(r.Name) == "" {
+				h.Set(r.Name, r.Value)
+			}
+		case HEADER_OP_REMOVE:
+			h.Del(r.Name)
+		case HEADER_OP_REPLACE:
+			// a new slice, the values may be shared, e.g. by cache entries
+			k := http.CanonicalHeaderKey(r.Name)
+			if vv, ok := h[k]; ok {
+				replaced := make([]string, len(vv))
+				for i, v := range vv {
+					replaced[i] = r.re.ReplaceAllString(v, r.Value)
+				}
+				h[k] = replaced
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_header_rules(t *testing.T) {
+	hr := &HeaderRules{
+		Response: []*HeaderRule{
+			{Op: "Set", Name: "Server", Value: "webx"},
+			{Op: "add", Name: "Cache-Control", Value: "no-transform"},
+			{Op: "remove", Name: "X-Powered-By"},
+			{Op: "replace", Name: "Location", Match: `^http://intranet\.local(:\d+)?/`,
+				Value: "https://www.example.com/"},
+		},
+		Security: true,
+	}
+	if err := hr.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{
+		"Server":          {"Apache"},
+		"Cache-Control":   {"max-age=60"},
+		"X-Powered-By":    {"PHP"},
+		"Location":        {"http://intranet.local:8080/login"},
+		"X-Frame-Options": {"DENY"},
+	}
+	ApplyHeaderRules(hr.Response, h)
+	for k, v := range map[string]string{
+		"Server":                    "webx",
+		"X-Powered-By":              "",
+		"Location":                  "https://www.example.com/login",
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"Strict-Transport-Security": "max-age=31536000",
+	} {
+		if h.Get(k) != v {
+			t.Errorf("%s: expected %q got %q", k, v, h.Get(k))
+		}
+	}
+	if len(h["Cache-Control"]) != 2 {
+		t.Error("expected 2 Cache-Control, got", h["Cache-Control"])
+	}
+
+	for _, bad := range []*HeaderRule{
+		{Op: "rename", Name: "A"},
+		{Op: "set"},
+		{Op: "replace", Name: "A", Match: "("},
+	} {
+		if err := (&HeaderRules{Request: []*HeaderRule{bad}}).Compile(); err == nil {
+			t.Error("expected error for", *bad)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Visitor identity assertions.
+//
+// After authenticating a visitor, the hub attaches HEADER_IDENTITY to the
+// request forwarded to plugs. The value carries the user, the request id
+// and an expiry, signed by HMAC-SHA256 with a secret shared by hub and
+// plugs, so that plugs can trust it and it can't be replayed for other
+// requests. Hubs drop any such header coming from visitors.
+
+// version tag of the assertion format
+const IDENTITY_VERSION = "v1"
+
+// lifetime of identity assertions
+const IDENTITY_TTL = 5 * time.Minute
+
+// errors of identity verification
+var (
+	ErrIdentityFormat  = errors.New("bad identity format")
+	ErrIdentitySign    = errors.New("bad identity signature")
+	ErrIdentityExpired = errors.New("identity expired")
+	ErrIdentityRequest = errors.New("identity for other request")
+)
+
+// sign the identity of the user for the request id
+func SignIdentity(key []byte, user, reqId string, exp time.Time) string {
+	payload := strings.Join([]string{IDENTITY_VERSION, user, reqId,
+		strconv.FormatInt(exp.Unix(), 10)}, "|")
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// verify the identity assertion for the request id, returns the user
+func VerifyIdentity(key []byte, value, reqId string) (string, error) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", ErrIdentityFormat
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return "", ErrIdentityFormat
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return "", ErrIdentityFormat
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(payload)
+	if !hmac.Equal(sig, m.Sum(nil)) {
+		return "", ErrIdentitySign
+	}
+	// the user may contain "|", so split from both ends
+	s := string(payload)
+	head := strings.SplitN(s, "|", 2)
+	if len(head) != 2 || head[0] != IDENTITY_VERSION {
+		return "", ErrIdentityFormat
+	}
+	s = head[1]
+	j := strings.LastIndexByte(s, '|')
+	if j < 0 {
+		return "", ErrIdentityFormat
+	}
+	exp, err := strconv.ParseInt(s[j+1:], 10, 64)
+	if err != nil {
+		return "", ErrIdentityFormat
+	}
+	s = s[:j]
+	k := strings.LastIndexByte(s, '|')
+	if k < 0 {
+		return "", ErrIdentityFormat
+	}
+	if s[k+1:] != reqId {
+		return "", ErrIdentityRequest
+	}
+	if time.Now().Unix() > exp {
+		return "", ErrIdentityExpired
+	}
+	return s[:k], nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_identity(t *testing.T) {
+	key := []byte("secret")
+	exp := time.Now().Add(IDENTITY_TTL)
+	v := SignIdentity(key, "alice|x@example.com", "42", exp)
+	// payload of v with signature of another identity
+	w := SignIdentity(key, "bob", "42", exp)
+	forged := v[:strings.IndexByte(v, '.')] + w[strings.IndexByte(w, '.'):]
+
+	if user, err := VerifyIdentity(key, v, "42"); err != nil || user != "alice|x@example.com" {
+		t.Error("expected alice, got", user, err)
+	}
+	for _, c := range []struct {
+		key   string
+		value string
+		reqId string
+		err   error
+	}{
+		{"other", v, "42", ErrIdentitySign},
+		{"secret", v, "43", ErrIdentityRequest},
+		{"secret", forged, "42", ErrIdentitySign},
+		{"secret", "junk", "42", ErrIdentityFormat},
+		{"secret", SignIdentity(key, "bob", "42", time.Now().Add(-time.Minute)), "42", ErrIdentityExpired},
+	} {
+		if _, err := VerifyIdentity([]byte(c.key), c.value, c.reqId); err != c.err {
+			t.Errorf("%s %s: expected %v got %v", c.key, c.reqId, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Streamed HTTP messages.
+//
+// Without streaming, one HTTP message is carried by exactly one websocket
+// message, whose frames go out only when the writer buffer fills up or the
+// message ends. That is fine for ordinary pages but stalls streamed bodies
+// like gRPC or server-sent events.
+//
+// With streaming, negotiated by HEADER_STREAM when the plug dials, one HTTP
+// message is carried by a series of binary websocket messages ended by an
+// empty one. Buffered bytes are sent whenever the body source is about to
+// be read again, so they never wait for data that is not there yet.
+
+// max size of one websocket message in a stream
+const STREAM_SEGMENT_SIZE = 32 * 1024
+
+// error for non binary messages inside a stream
+var ErrStreamType = errors.New("unexpected stream message type")
+
+// StreamWriter writes one streamed HTTP message into the websocket
+type StreamWriter struct {
+	mu  sync.Mutex
+	ws  *websocket.Conn
+	buf []byte // pending bytes of next segment
+}
+
+// create a writer of one streamed message
+func NewStreamWriter(ws *websocket.Conn) *StreamWriter {
+	return &StreamWriter{ws: ws, buf: make([]byte, 0, STREAM_SEGMENT_SIZE)}
+}
+
+// buffer the bytes, full segments are sent right away
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		m := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf, p, n = sw.buf[:len(sw.buf)+m], p[m:], n+m
+		if len(sw.buf) == cap(sw.buf) {
+			if err := sw.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// send buffered bytes as one segment
+func (sw *StreamWriter) Flush() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.flush()
+}
+
+func (sw *StreamWriter) flush() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	err := sw.ws.WriteMessage(websocket.BinaryMessage, sw.buf)
+	sw.buf = sw.buf[:0]
+	return err
+}
+
+// flush and end the streamed message
+func (sw *StreamWriter) Close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	return sw.ws.WriteMessage(websocket.BinaryMessage, []byte{})
+}
+
+// a body flushing the stream before each read
+type flushingBody struct {
+	io.ReadCloser
+	sw *StreamWriter
+}
+
+func (fb *flushingBody) Read(p []byte) (int, error) {
+	if err := fb.sw.Flush(); err != nil {
+		return 0, err
+	}
+	return fb.ReadCloser.Read(p)
+}
+
+// write the request as streamed message, like Request.WriteProxy
+func StreamRequest(ws *websocket.Conn, req *http.Request) error {
+	sw := NewStreamWriter(ws)
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &flushingBody{req.Body, sw}
+	}
+	err := req.WriteProxy(sw)
+	// end the message even if the body failed, so the peer reads on
+	if cerr := sw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write the response as streamed message, like Response.Write
+func StreamResponse(ws *websocket.Conn, rsp *http.Response) error {
+	sw := NewStreamWriter(ws)
+	if rsp.Body != nil && rsp.Body != http.NoBody {
+		rsp.Body = &flushingBody{rsp.Body, sw}
+	}
+	err := rsp.Write(sw)
+	// end the message even if the body failed, like StreamRequest
+	if cerr := sw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// StreamReader reads one streamed HTTP message from the websocket, it
+// returns io.EOF at the ending empty message.
+type StreamReader struct {
+	ws  *websocket.Conn
+	r   io.Reader // current segment
+	n   int       // bytes read from current segment
+	err error     // sticky error, io.EOF at end of stream
+}
+
+// create a reader of one streamed message
+func NewStreamReader(ws *websocket.Conn) *StreamReader {
+	return &StreamReader{ws: ws}
+}
+
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	for len(p) > 0 && sr.err == nil {
+		if sr.r == nil {
+			mt, r, err := sr.ws.NextReader()
+			if err != nil {
+				sr.err = err
+				break
+			}
+			if mt != websocket.BinaryMessage {
+				sr.err = ErrStreamType
+				break
+			}
+			sr.r, sr.n = r, 0
+		}
+		n, err := sr.r.Read(p)
+		sr.n += n
+		if err == io.EOF {
+			if sr.n == 0 {
+				// the empty segment ends the stream
+				sr.err = io.EOF
+			}
+			sr.r, err = nil, nil
+		} else if err != nil {
+			sr.err = err
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	if len(p) == 0 && sr.err == nil {
+		return 0, nil
+	}
+	return 0, sr.err
+}
+
+// skip the rest of the streamed message so that next one can be read.
+// returns nil if the stream ended well.
+func (sr *StreamReader) Drain() error {
+	if _, err := io.Copy(ioutil.Discard, sr); err != nil {
+		return err
+	}
+	return nil
+}
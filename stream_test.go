@@ -0,0 +1,120 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"bufio"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// a connected pair of websockets
+func ws_pair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	ch := make(chan *websocket.Conn, 1)
+	up := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			c, err := up.Upgrade(w, r, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- c
+		}))
+	t.Cleanup(srv.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[4:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, <-ch
+}
+
+func Test_stream(t *testing.T) {
+	a, b := ws_pair(t)
+	defer a.Close()
+	defer b.Close()
+
+	big := strings.Repeat("x", 3*STREAM_SEGMENT_SIZE+7)
+	go func() {
+		for _, body := range []string{"hello", big} {
+			rsp := &http.Response{
+				StatusCode:       200,
+				ProtoMajor:       1,
+				ProtoMinor:       1,
+				ContentLength:    -1,
+				TransferEncoding: []string{"chunked"},
+				Body:             ioutil.NopCloser(strings.NewReader(body)),
+				Trailer:          http.Header{"Grpc-Status": {"0"}},
+			}
+			if err := StreamResponse(a, rsp); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	for _, want := range []string{"hello", big} {
+		sr := NewStreamReader(b)
+		rsp, err := http.ReadResponse(bufio.NewReader(sr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil || string(body) != want {
+			t.Error("expected body of", len(want), "got", len(body), err)
+		}
+		if v := rsp.Trailer.Get("Grpc-Status"); v != "0" {
+			t.Error("expected trailer 0, got", v)
+		}
+		if err = sr.Drain(); err != nil {
+			t.Error("drain:", err)
+		}
+	}
+}
+
+func Test_stream_broken(t *testing.T) {
+	a, b := ws_pair(t)
+	defer a.Close()
+	defer b.Close()
+
+	reset := errors.New("backend reset")
+	go func() {
+		for _, body := range []io.Reader{
+			io.MultiReader(strings.NewReader("part"), iotest.ErrReader(reset)),
+			strings.NewReader("next"),
+		} {
+			rsp := &http.Response{
+				StatusCode:       200,
+				ProtoMajor:       1,
+				ProtoMinor:       1,
+				ContentLength:    -1,
+				TransferEncoding: []string{"chunked"},
+				Body:             ioutil.NopCloser(body),
+			}
+			StreamResponse(a, rsp)
+		}
+	}()
+
+	// the broken body still ends its message, the next one is intact
+	for i, want := range []string{"part", "next"} {
+		sr := NewStreamReader(b)
+		rsp, err := http.ReadResponse(bufio.NewReader(sr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		if string(body) != want || (err != nil) != (i == 0) {
+			t.Error("expected body", want, "got", string(body), err)
+		}
+		if err = sr.Drain(); err != nil {
+			t.Error("drain:", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+)
+
+// Tunneled TCP connections.
+//
+// A tunnel carries the bytes of one TCP connection over a websocket of its
+// own, dialed by the plug to HUB_TUNNEL_PATH when the hub asks for it with
+// a CONNECT request holding HEADER_TUNNEL. Bytes go in binary messages, and
+// an empty one tells the peer no more bytes follow in that direction, so
+// half-closed connections keep working.
+
+// copy bytes between the websocket and the conn both ways until both
+// directions end or any fails, then close both
+func Tunnel(ws *websocket.Conn, c net.Conn) error {
+	// tunneled bytes are mostly encrypted already
+	ws.EnableWriteCompression(false)
+	errc := make(chan error, 2)
+	go func() { errc <- tunnel_out(ws, c) }()
+	go func() { errc <- tunnel_in(ws, c) }()
+	err := <-errc
+	if err != nil {
+		ws.Close()
+		c.Close()
+		<-errc
+		return err
+	}
+	err = <-errc
+	ws.Close()
+	c.Close()
+	return err
+}
+
+// copy bytes of the conn into the websocket, ending with an empty message
+func tunnel_out(ws *websocket.Conn, c net.Conn) error {
+	buf := make([]byte, STREAM_SEGMENT_SIZE)
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return ws.WriteMessage(websocket.BinaryMessage, []byte{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copy messages of the websocket into the conn until an empty one, which
+// half-closes the conn if it can
+func tunnel_in(ws *websocket.Conn, c net.Conn) error {
+	for {
+		mt, r, err := ws.NextReader()
+		if err != nil {
+			return err
+		}
+		if mt != websocket.BinaryMessage {
+			return ErrStreamType
+		}
+		n, err := io.Copy(c, r)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if cw, ok := c.(interface{ CloseWrite() error }); ok {
+				return cw.CloseWrite()
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webswitch
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// a connected pair of TCP conns
+func tcp_pair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn), (<-ch).(*net.TCPConn)
+}
+
+func Test_tunnel(t *testing.T) {
+	a, b := ws_pair(t)
+	// visitor <-> hub end ... plug end <-> service
+	visitor, hub_end := tcp_pair(t)
+	plug_end, service := tcp_pair(t)
+	done := make(chan error, 2)
+	go func() { done <- Tunnel(a, hub_end) }()
+	go func() { done <- Tunnel(b, plug_end) }()
+
+	// the visitor half-closes after its request, the service still answers
+	big := strings.Repeat("x", 2*STREAM_SEGMENT_SIZE+3)
+	go func() {
+		visitor.Write([]byte(big))
+		visitor.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(service)
+	if err != nil || string(got) != big {
+		t.Fatal("service got", len(got), err)
+	}
+	service.Write([]byte("pong"))
+	service.Close()
+	if got, err = ioutil.ReadAll(visitor); err != nil || string(got) != "pong" {
+		t.Error("visitor got", string(got), err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error("tunnel error:", err)
+		}
+	}
+	visitor.Close()
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/yf13/webswitch/webx_hub"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// defaults of ctl commands
+const (
+	ADMIN_URL     = "http://127.0.0.1:8082" // address of the hub admin API
+	ADMIN_TIMEOUT = 10 * time.Second
+	DRAIN_WAIT    = 30 * time.Second // time to disconnect drained plugs
+)
+
+// AdminClient calls the admin API of a hub
+type AdminClient struct {
+	Url   string // base URL of the admin API
+	Token string // AdminToken of the hub
+}
+
+// call the admin API, returns the body of a successful response
+func (ac *AdminClient) call(method, path string, query url.Values) ([]byte, error) {
+	u := strings.TrimRight(ac.Url, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.Token)
+	rsp, err := (&http.Client{Timeout: ADMIN_TIMEOUT}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err == nil && rsp.StatusCode != http.StatusOK {
+		err = errors.New(rsp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	return body, err
+}
+
+// value of the environment variable, or the default if unset
+func env_or(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// run a ctl command against the hub admin API, printing to out
+func ctl(cmd string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	ac := &AdminClient{}
+	fs.StringVar(&ac.Url, "admin", env_or("WEBX_ADMIN", ADMIN_URL), "URL of the hub admin API, or $WEBX_ADMIN.")
+	fs.StringVar(&ac.Token, "token", os.Getenv("WEBX_ADMIN_TOKEN"), "AdminToken of the hub, or $WEBX_ADMIN_TOKEN.")
+	as_json := fs.Bool("json", false, "print JSON instead of tables.")
+	wait := DRAIN_WAIT
+	if cmd == "drain" {
+		fs.DurationVar(&wait, "wait", DRAIN_WAIT, "time to disconnect the plug after drain, in whole seconds rounded up, 0 keeps it.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "status", "plugs":
+		body, err := ac.call("GET", "/"+cmd, nil)
+		if err != nil {
+			return err
+		}
+		if *as_json {
+			var buf bytes.Buffer
+			if err = json.Indent(&buf, body, "", "  "); err != nil {
+				return err
+			}
+			fmt.Fprintln(out, buf.String())
+			return nil
+		}
+		if cmd == "status" {
+			var st webx_hub.HubStatus
+			if err = json.Unmarshal(body, &st); err == nil {
+				print_status(out, &st)
+			}
+		} else {
+			var list []webx_hub.PlugInfo
+			if err = json.Unmarshal(body, &list); err == nil {
+				print_plugs(out, list)
+			}
+		}
+		return err
+	case "kick", "drain":
+		id := fs.Arg(0)
+		if _, err := strconv.Atoi(id); err != nil || fs.NArg() != 1 {
+			return errors.New("usage: webx " + cmd + " [options] <plug id>")
+		}
+		query := url.Values{"id": {id}}
+		if cmd == "drain" {
+			// the hub takes whole seconds, a short wait must not keep the plug
+			if wait > 0 {
+				wait = (wait + time.Second - 1).Truncate(time.Second)
+			}
+			query.Set("wait", strconv.Itoa(int(wait/time.Second)))
+		}
+		body, err := ac.call("POST", "/plugs/"+cmd, query)
+		if err != nil {
+			return err
+		}
+		done := strings.TrimSpace(string(body)) == "1"
+		if *as_json {
+			d, _ := json.Marshal(map[string]interface{}{"Id": id, "Found": done})
+			fmt.Fprintln(out, string(d))
+		}
+		if !done {
+			return errors.New("plug " + id + " not found")
+		} else if *as_json {
+			return nil
+		} else if cmd == "kick" {
+			fmt.Fprintln(out, "plug", id, "disconnected")
+		} else if wait > 0 {
+			fmt.Fprintln(out, "plug", id, "draining, disconnect in", wait)
+		} else {
+			fmt.Fprintln(out, "plug", id, "draining")
+		}
+		return nil
+	}
+	return errors.New("unknown command: " + cmd)
+}
+
+// print vhosts of the hub status as a table
+func print_status(out io.Writer, st *webx_hub.HubStatus) {
+	type row struct {
+		plugs int
+		uses  uint64
+	}
+	rows := make(map[string]*row)
+	if st.PlugRegistry != nil {
+		for vhost, pbl := range st.Hosts {
+			r := &row{}
+			for _, pb := range pbl {
+				for _, pe := range pb.Plugs {
+					r.plugs += 1
+					r.uses += pe.Uses
+				}
+			}
+			rows[vhost] = r
+		}
+	}
+	for vhost := range st.Disabled {
+		if _, ok := rows[vhost]; !ok {
+			rows[vhost] = &row{}
+		}
+	}
+	vhosts := make([]string, 0, len(rows))
+	for vhost := range rows {
+		vhosts = append(vhosts, vhost)
+	}
+	sort.Strings(vhosts)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VHOST\tSTATE\tPLUGS\tUSES")
+	for _, vhost := range vhosts {
+		state := "up"
+		if rows[vhost].plugs == 0 {
+			state = "down"
+		}
+		name := strings.ToLower(vhost)
+		if h, _, err := net.SplitHostPort(name); err == nil {
+			name = h
+		}
+		for _, k := range []string{strings.ToLower(vhost), name} {
+			if retry, ok := st.Disabled[k]; ok {
+				state = "maintenance"
+				if retry != "" {
+					state += " (retry " + retry + "s)"
+				}
+				break
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", vhost, state, rows[vhost].plugs, rows[vhost].uses)
+	}
+	tw.Flush()
+	fmt.Fprintln(out, "pending requests:", st.Pending)
+}
+
+// print plugs as a table
+func print_plugs(out io.Writer, list []webx_hub.PlugInfo) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOSTS\tLIMIT\tUSES\tAGE\tREMOTE\tSTREAM\tSTATE")
+	for _, pi := range list {
+		limit := "-"
+		if pi.Limit > 0 {
+			limit = strconv.FormatInt(pi.Limit, 10)
+		}
+		age := "-"
+		if pi.Birth > 0 {
+			age = time.Since(time.Unix(pi.Birth, 0)).Round(time.Second).String()
+		}
+		state := "active"
+		if pi.Draining {
+			state = "draining"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\t%t\t%s\n", pi.Id,
+			strings.Join(pi.Hosts, ","), limit, pi.Uses, age, pi.Remote, pi.Stream, state)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ctl(t *testing.T) {
+	var last string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		last = r.Method + " " + r.URL.RequestURI()
+		switch r.URL.Path {
+		case "/status":
+			fmt.Fprint(w, `{"Hosts": {"www.test": [{"Limit": 0, "Plugs": [{"Uses": 3, "Conn": {"Id": 1}},
+				{"Uses": 2, "Conn": {"Id": 2}}]}]}, "Disabled": {"api.test": "60"}, "Pending": 4}`)
+		case "/plugs":
+			fmt.Fprint(w, `[{"Id": 1, "Hosts": ["www.test"], "Uses": 3, "Remote": "10.0.0.1:5000"},
+				{"Id": 2, "Hosts": ["www.test"], "Limit": 4096, "Draining": true}]`)
+		case "/plugs/kick", "/plugs/drain":
+			if r.FormValue("id") == "1" {
+				fmt.Fprintln(w, 1)
+			} else {
+				fmt.Fprintln(w, 0)
+			}
+		}
+	}))
+	defer srv.Close()
+	run := func(cmd string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := ctl(cmd, append([]string{"-admin", srv.URL, "-token", "s3"}, args...), &out)
+		return out.String(), err
+	}
+
+	out, err := run("status")
+	if err != nil || !strings.Contains(out, "www.test  up") ||
+		!strings.Contains(out, "api.test  maintenance (retry 60s)") ||
+		!strings.Contains(out, "pending requests: 4") {
+		t.Error("unexpected status", err, "\n"+out)
+	}
+	out, err = run("plugs")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if err != nil || len(lines) != 3 || !strings.Contains(lines[1], "10.0.0.1:5000") ||
+		!strings.HasSuffix(lines[2], "draining") {
+		t.Error("unexpected plugs", err, "\n"+out)
+	}
+	if out, err = run("plugs", "-json"); err != nil || !strings.Contains(out, `"Draining": true`) {
+		t.Error("unexpected plugs JSON", err, out)
+	}
+	if _, err = run("kick", "1"); err != nil || last != "POST /plugs/kick?id=1" {
+		t.Error("unexpected kick", err, last)
+	}
+	if _, err = run("drain", "-wait", "1m", "1"); err != nil || last != "POST /plugs/drain?id=1&wait=60" {
+		t.Error("unexpected drain", err, last)
+	}
+	if out, err = run("drain", "-wait", "500ms", "1"); err != nil || last != "POST /plugs/drain?id=1&wait=1" ||
+		!strings.Contains(out, "disconnect in 1s") {
+		t.Error("expected short wait rounded up, got", err, last, out)
+	}
+	if _, err = run("kick", "2"); err == nil {
+		t.Error("expected error for unknown plug")
+	}
+	if out, err = run("drain", "-json", "2"); err == nil || !strings.Contains(out, `"Found":false`) {
+		t.Error("expected JSON and error for unknown plug, got", err, out)
+	}
+	if _, err = run("kick", "x"); err == nil {
+		t.Error("expected usage error")
+	}
+	var out2 bytes.Buffer
+	if err = ctl("status", []string{"-admin", srv.URL, "-token", "bad"}, &out2); err == nil ||
+		!strings.Contains(err.Error(), "401") {
+		t.Error("expected 401, got", err)
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+/*
+
+This is the webx command, running both programs of WebSwitch and operating
+running hubs.
+
+	webx hub [options]           run the hub, see webx_hub
+	webx plug [options]          run a plug, see webx_plug
+	webx status [options]        show vhosts of a running hub
+	webx plugs [options]         list plugs of a running hub
+	webx kick [options] <id>     disconnect a plug
+	webx drain [options] <id>    send no more requests to a plug, then
+	                             disconnect it after -wait
+	webx version                 print the version
+
+The status, plugs, kick and drain commands talk to the hub admin API given by
+-admin or $WEBX_ADMIN, with the token given by -token or $WEBX_ADMIN_TOKEN.
+They print tables, or JSON with -json.
+
+*/
+package main
@@ -0,0 +1,59 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/yf13/webswitch"
+	"github.com/yf13/webswitch/webx_hub"
+	"github.com/yf13/webswitch/webx_plug"
+	"os"
+)
+
+// usage of the command
+const USAGE = `usage: webx <command> [options]
+
+commands:
+  hub      run the hub
+  plug     run a plug
+  status   show vhosts of a running hub
+  plugs    list plugs of a running hub
+  kick     disconnect a plug by id
+  drain    send no more requests to a plug, then disconnect it
+  version  print the version
+
+Use "webx <command> -h" for options of a command.
+`
+
+// program entrance
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, USAGE)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "hub":
+		webx_hub.Main(args)
+	case "plug":
+		webx_plug.Main(args)
+	case "status", "plugs", "kick", "drain":
+		if err := ctl(cmd, args, os.Stdout); err == flag.ErrHelp {
+			os.Exit(2)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "webx "+cmd+":", err)
+			os.Exit(1)
+		}
+	case "version":
+		fmt.Println("webx", webswitch.APP_VERSION)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(USAGE)
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command:", cmd)
+		fmt.Fprint(os.Stderr, USAGE)
+		os.Exit(2)
+	}
+}
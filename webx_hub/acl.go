@@ -0,0 +1,123 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"github.com/oschwald/geoip2-golang"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AccessRules decide which clients may reach a published host. Denying
+// rules are checked first, then if any allowing rule exists the client
+// must match one of them.
+type AccessRules struct {
+	Allow          []string // CIDRs or IPs allowed
+	Deny           []string // CIDRs or IPs denied
+	AllowCountries []string // ISO country codes allowed, needs GeoIP
+	DenyCountries  []string // ISO country codes denied, needs GeoIP
+
+	allow []*net.IPNet // parsed Allow
+	deny  []*net.IPNet // parsed Deny
+}
+
+// parse the CIDR lists and normalize country codes
+func (ar *AccessRules) parse() error {
+	var err error
+	if ar.allow, err = parse_cidrs(ar.Allow); err != nil {
+		return err
+	}
+	if ar.deny, err = parse_cidrs(ar.Deny); err != nil {
+		return err
+	}
+	for i, c := range ar.AllowCountries {
+		ar.AllowCountries[i] = strings.ToUpper(strings.TrimSpace(c))
+	}
+	for i, c := range ar.DenyCountries {
+		ar.DenyCountries[i] = strings.ToUpper(strings.TrimSpace(c))
+	}
+	return nil
+}
+
+// whether country rules exist
+func (ar *AccessRules) by_country() bool {
+	return len(ar.AllowCountries) > 0 || len(ar.DenyCountries) > 0
+}
+
+// check the client IP and its country, which is empty if unknown
+func (ar *AccessRules) permits(ip net.IP, country string) bool {
+	if in_nets(ip, ar.deny) || (country != "" && has(ar.DenyCountries, country)) {
+		return false
+	}
+	if len(ar.allow) == 0 && len(ar.AllowCountries) == 0 {
+		return true
+	}
+	return in_nets(ip, ar.allow) || (country != "" && has(ar.AllowCountries, country))
+}
+
+// check if the list has the string
+func has(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// the GeoIP country database, nil unless configured
+var geo *geoip2.Reader
+
+// open the GeoIP database file, e.g. GeoLite2-Country.mmdb
+func OpenGeoIP(file string) error {
+	db, err := geoip2.Open(file)
+	if err == nil {
+		geo = db
+	}
+	return err
+}
+
+// ISO country code of the IP, empty if unknown
+func country_of(ip net.IP) string {
+	if geo == nil {
+		return ""
+	}
+	c, err := geo.Country(ip)
+	if err != nil {
+		log.Println("error geoip:", err)
+		return ""
+	}
+	return c.Country.IsoCode
+}
+
+// check the global and vhost access rules for the client request
+func access_allowed(r *http.Request) bool {
+	var rules []*AccessRules
+	if config.Access != nil {
+		rules = append(rules, config.Access)
+	}
+	if hc := config.host(r.Host); hc != nil && hc.Access != nil {
+		rules = append(rules, hc.Access)
+	}
+	if len(rules) == 0 {
+		return true
+	}
+	ip := net.ParseIP(client_ip(r))
+	if ip == nil {
+		return false
+	}
+	country, looked := "", false
+	for _, ar := range rules {
+		if ar.by_country() && !looked {
+			country, looked = country_of(ip), true
+		}
+		if !ar.permits(ip, country) {
+			return false
+		}
+	}
+	return true
+}
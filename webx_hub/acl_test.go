@@ -0,0 +1,62 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func Test_access(t *testing.T) {
+	open := &AccessRules{}
+	deny := &AccessRules{Deny: []string{"10.0.0.0/8"}, DenyCountries: []string{"xx"}}
+	allow := &AccessRules{Allow: []string{"192.168.0.0/16", "::1"},
+		AllowCountries: []string{"nz"}, Deny: []string{"192.168.9.9"}}
+	for _, ar := range []*AccessRules{open, deny, allow} {
+		if err := ar.parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (&AccessRules{Allow: []string{"bad"}}).parse(); err == nil {
+		t.Error("expected error for bad IP")
+	}
+
+	for _, c := range []struct {
+		ar      *AccessRules
+		ip, cc  string
+		permits bool
+	}{
+		{open, "1.2.3.4", "", true},
+		{deny, "1.2.3.4", "", true},
+		{deny, "10.1.2.3", "", false},
+		{deny, "1.2.3.4", "XX", false},
+		{allow, "192.168.1.1", "", true},
+		{allow, "192.168.9.9", "", false},
+		{allow, "::1", "", true},
+		{allow, "1.2.3.4", "", false},
+		{allow, "1.2.3.4", "NZ", true},
+	} {
+		if got := c.ar.permits(net.ParseIP(c.ip), c.cc); got != c.permits {
+			t.Errorf("%v %s %s: expected %v", c.ar, c.ip, c.cc, c.permits)
+		}
+	}
+}
+
+func Test_access_config(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hub.json")
+	for conf, want := range map[string]string{
+		`{"Hosts": {"www.test": {"Access": {"DenyCountries": ["XX"]}}}}`: "www.test: country rules need GeoIP",
+		`{"Access": {"AllowCountries": ["NZ"]}}`:                         "country rules need GeoIP",
+		`{"Hosts": {"www.test": {"Access": {"Deny": ["10.0.0.0/8"]}}}}`:  "",
+	} {
+		ioutil.WriteFile(file, []byte(conf), 0600)
+		_, err := LoadConfig(file)
+		if (err == nil && want != "") || (err != nil && err.Error() != want) {
+			t.Error(conf, "expected", want, "got", err)
+		}
+	}
+}
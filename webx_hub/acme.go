@@ -0,0 +1,132 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AcmeIssuer obtains and renews visitor certificates through ACME for
+// published hosts. Only host names matching the allowlist and having
+// registered plugs get certificates, both HTTP-01 and TLS-ALPN-01
+// challenges are answered.
+type AcmeIssuer struct {
+	mgr   *autocert.Manager
+	allow []string // allowed names, "*.example.com" matches subdomains
+}
+
+// create the ACME issuer.
+//   - dirURL is the ACME directory, e.g. a local Pebble for testing
+//   - cacheDir keeps account key and certificates on disk
+//   - caFile optionally gives root CAs to trust the ACME server
+//   - hosts is the comma separated allowlist
+func NewAcmeIssuer(dirURL, cacheDir, email, caFile, hosts string) (*AcmeIssuer, error) {
+	ai := &AcmeIssuer{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			ai.allow = append(ai.allow, h)
+		}
+	}
+	if len(ai.allow) == 0 {
+		return nil, errors.New("empty acme hosts")
+	}
+	client := &acme.Client{DirectoryURL: dirURL}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certs in " + caFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	ai.mgr = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: ai.host_policy,
+		Client:     client,
+		Email:      email,
+	}
+	return ai, nil
+}
+
+// check whether the host name is in the allowlist
+func (ai *AcmeIssuer) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, a := range ai.allow {
+		if a == host {
+			return true
+		}
+		if strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// autocert host policy: allowed and currently published through the hub
+func (ai *AcmeIssuer) host_policy(_ context.Context, host string) error {
+	if !ai.allowed(host) {
+		return errors.New("acme: host not allowed " + host)
+	}
+	if hub.names_count([]string{host}) == 0 {
+		return errors.New("acme: host not registered " + host)
+	}
+	return nil
+}
+
+// wrap visitor http handler to answer HTTP-01 challenges
+func (ai *AcmeIssuer) http_handler(fallback http.Handler) http.Handler {
+	return ai.mgr.HTTPHandler(fallback)
+}
+
+// TLS config for visitor and plug listeners. Certificates from the cert
+// store take precedence, then ACME issued ones, and finally the default
+// of the cert store. Either certs or ai may be nil.
+func visitor_tls_config(certs *CertStore, ai *AcmeIssuer) *tls.Config {
+	// prefer HTTP/2 for visitors
+	cfg := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	if ai != nil {
+		cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	}
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// TLS-ALPN-01 challenges always go to the ACME issuer
+		if ai != nil && len(hello.SupportedProtos) == 1 &&
+			hello.SupportedProtos[0] == acme.ALPNProto {
+			return ai.mgr.GetCertificate(hello)
+		}
+		if certs != nil {
+			if crt := certs.lookup(hello.ServerName); crt != nil {
+				return crt, nil
+			}
+		}
+		if ai != nil && hello.ServerName != "" {
+			crt, err := ai.mgr.GetCertificate(hello)
+			if err == nil {
+				return crt, nil
+			}
+			log.Println("error acme cert:", err)
+		}
+		if certs != nil {
+			return certs.GetCertificate(hello)
+		}
+		return nil, errors.New("no certificate for " + hello.ServerName)
+	}
+	return cfg
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// admin API to operate the hub at runtime, served on its own listener.
+// Requests need "Authorization: Bearer <AdminToken>", e.g.
+//
+//	curl -X POST -H "Authorization: Bearer $TOKEN" \
+//	  "http://127.0.0.1:8082/hosts/disable?host=www.example.com&retry=120"
+//
+// routes:
+//
+//	GET  /status                      hub status as JSON
+//	GET  /plugs                       registered plugs as JSON
+//	POST /plugs/kick?id=              disconnect a plug
+//	POST /plugs/drain?id=&wait=       send no more requests to a plug, and
+//	                                  disconnect it after wait seconds
+//	POST /hosts/disable?host=&retry=  maintenance mode, visitors get 503
+//	POST /hosts/enable?host=          end maintenance mode
+//	POST /limits?host=                set rate limits from JSON body,
+//	                                  DELETE drops them, host "" is default
+//	POST /pending/purge               drop pending requests
+//	POST /cache?host=&prefix=         purge cached responses, or DELETE
+func admin_mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", admin_auth("GET", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, hub.status_query(false))
+	}))
+	mux.HandleFunc("/plugs", admin_auth("GET", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, hub.command(CMD_PLUG_LIST))
+	}))
+	mux.HandleFunc("/plugs/kick", admin_auth("POST", func(w http.ResponseWriter, r *http.Request) {
+		id := r.FormValue("id")
+		if _, err := strconv.Atoi(id); err != nil {
+			http.Error(w, "bad plug id", http.StatusBadRequest)
+			return
+		}
+		admin_reply(w, r, hub.command(CMD_PLUG_KICK, id))
+	}))
+	mux.HandleFunc("/plugs/drain", admin_auth("POST", func(w http.ResponseWriter, r *http.Request) {
+		id, wait := r.FormValue("id"), r.FormValue("wait")
+		if _, err := strconv.Atoi(id); err != nil {
+			http.Error(w, "bad plug id", http.StatusBadRequest)
+			return
+		}
+		if _, err := strconv.ParseUint(wait, 10, 32); wait != "" && err != nil {
+			http.Error(w, "bad wait seconds", http.StatusBadRequest)
+			return
+		}
+		admin_reply(w, r, hub.command(CMD_PLUG_DRAIN, id, wait))
+	}))
+	mux.HandleFunc("/hosts/disable", admin_auth("POST", func(w http.ResponseWriter, r *http.Request) {
+		host, retry := r.FormValue("host"), r.FormValue("retry")
+		if _, err := strconv.ParseUint(retry, 10, 32); retry != "" && err != nil {
+			http.Error(w, "bad retry seconds", http.StatusBadRequest)
+			return
+		}
+		if admin_host(w, host) {
+			admin_reply(w, r, hub.command(CMD_HOST_OFF, host, retry))
+		}
+	}))
+	mux.HandleFunc("/hosts/enable", admin_auth("POST", func(w http.ResponseWriter, r *http.Request) {
+		if host := r.FormValue("host"); admin_host(w, host) {
+			admin_reply(w, r, hub.command(CMD_HOST_ON, host))
+		}
+	}))
+	mux.HandleFunc("/limits", admin_auth("POST,DELETE", func(w http.ResponseWriter, r *http.Request) {
+		rates := ""
+		if r.Method == "POST" {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+			if err != nil || len(body) == 0 {
+				http.Error(w, "rate limits required", http.StatusBadRequest)
+				return
+			}
+			rates = string(body)
+		}
+		reply := hub.command(CMD_SET_RATES, r.FormValue("host"), rates)
+		if reply != "ok" {
+			http.Error(w, reply, http.StatusBadRequest)
+			return
+		}
+		admin_reply(w, r, reply)
+	}))
+	mux.HandleFunc("/pending/purge", admin_auth("POST", func(w http.ResponseWriter, r *http.Request) {
+		admin_reply(w, r, hub.command(CMD_REQ_PURGE))
+	}))
+	mux.HandleFunc("/cache", admin_auth("POST,DELETE", func(w http.ResponseWriter, r *http.Request) {
+		host := r.FormValue("host")
+		if admin_host(w, host) {
+			admin_reply(w, r, strconv.Itoa(purge_cache(host, r.FormValue("prefix"))))
+		}
+	}))
+	return mux
+}
+
+// check the admin token and method of requests to the handler, methods
+// are comma separated like "POST,DELETE"
+func admin_auth(methods string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" || subtle.ConstantTimeCompare(
+			[]byte(r.Header.Get("Authorization")),
+			[]byte("Bearer "+config.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !has(strings.Split(methods, ","), r.Method) {
+			w.Header().Set("Allow", strings.ReplaceAll(methods, ",", ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// check the host argument, answers 400 if missing
+func admin_host(w http.ResponseWriter, host string) bool {
+	if host == "" {
+		http.Error(w, "host required", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// log and answer the reply of an admin command
+func admin_reply(w http.ResponseWriter, r *http.Request, reply string) {
+	log.Println("admin", r.Method, r.URL.RequestURI(), "from", r.RemoteAddr+":", reply)
+	fmt.Fprintln(w, reply)
+}
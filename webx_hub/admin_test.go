@@ -0,0 +1,83 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_admin_auth(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+
+	for _, c := range []struct {
+		token, method, auth string
+		code                int
+	}{
+		{"", "POST", "Bearer ", http.StatusUnauthorized},
+		{"s3", "POST", "", http.StatusUnauthorized},
+		{"s3", "POST", "Bearer s4", http.StatusUnauthorized},
+		{"s3", "GET", "Bearer s3", http.StatusMethodNotAllowed},
+		{"s3", "POST", "Bearer s3", http.StatusOK},
+		{"s3", "DELETE", "Bearer s3", http.StatusOK},
+	} {
+		config = &HubConfig{AdminToken: c.token}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "/limits", nil)
+		r.Header.Set("Authorization", c.auth)
+		admin_auth("POST,DELETE", ok)(w, r)
+		if w.Code != c.code {
+			t.Error(c, "got", w.Code)
+		}
+	}
+	// DELETE only where routes give it a meaning
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/plugs/kick", nil)
+	r.Header.Set("Authorization", "Bearer s3")
+	admin_auth("POST", ok)(w, r)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Error("expected DELETE refused, got", w.Code)
+	}
+}
+
+func Test_maintenance(t *testing.T) {
+	h := &Hub{disabled: map[string]string{"www.test": "60", "api.test:8080": ""}}
+	for vhost, want := range map[string]bool{
+		"www.test": true, "WWW.test:8080": true, "api.test:8080": true,
+		"api.test": false, "other.test": false,
+	} {
+		if _, off := h.maintenance(vhost); off != want {
+			t.Error(vhost, "expected", want)
+		}
+	}
+	if retry, _ := h.maintenance("www.test:443"); retry != "60" {
+		t.Error("expected retry 60, got", retry)
+	}
+}
+
+func Test_set_rates(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Rates: RateLimits{Host: Rate{PerSec: 1}},
+		Hosts: map[string]*HostConfig{"own.test": {Rates: &RateLimits{Host: Rate{PerSec: 2}}}}}
+	rl := &RateLimiter{}
+	rl.set_rates("", &RateLimits{Host: Rate{PerSec: 3}})
+	rl.set_rates("www.test", &RateLimits{Host: Rate{PerSec: 4}})
+	for vhost, want := range map[string]float64{
+		"www.test:8080": 4, "own.test": 2, "other.test": 3,
+	} {
+		if got := rl.rates(vhost).Host.PerSec; got != want {
+			t.Error(vhost, "expected", want, "got", got)
+		}
+	}
+	rl.set_rates("", nil)
+	rl.set_rates("WWW.test", nil)
+	if got := rl.rates("www.test").Host.PerSec; got != 1 {
+		t.Error("expected configured default, got", got)
+	}
+}
@@ -0,0 +1,546 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// paths handled by the hub itself on vhosts with OpenID Connect login
+const (
+	AUTH_CALLBACK_PATH = "/_webx/auth/callback"
+	AUTH_LOGOUT_PATH   = "/_webx/auth/logout"
+)
+
+// cookies of the hub, never forwarded to plugs
+const (
+	SESSION_COOKIE = "webx_session"
+	STATE_COOKIE   = "webx_state"
+)
+
+// default lifetime of login sessions
+const SESSION_SECS = 8 * 3600
+
+// lifetime of pending logins
+const LOGIN_SECS = 600
+
+// AuthConfig makes the hub authenticate visitors of a vhost before
+// forwarding their requests. With both methods given, valid Basic
+// credentials are accepted and others are sent to the OIDC login.
+type AuthConfig struct {
+	Realm    string      // Basic auth realm, defaults to the vhost
+	Htpasswd string      // htpasswd file for Basic auth
+	OIDC     *OIDCConfig // OpenID Connect login
+}
+
+// OIDCConfig is the OpenID Connect relying party setup of a vhost
+type OIDCConfig struct {
+	Issuer       string   // issuer URL, its discovery document is used
+	IssuerCA     string   // optional root CA pem to trust the issuer
+	ClientID     string   // client id registered at the issuer
+	ClientSecret string   // client secret registered at the issuer
+	RedirectURL  string   // defaults to scheme://vhost/_webx/auth/callback
+	Scopes       []string // scopes besides "openid"
+	Users        []string // optional allowlist of verified emails or subjects
+	SessionSecs  int      // session lifetime, SESSION_SECS if 0
+	CookieSecret string   // key to sign cookies, random if empty
+
+	mu       sync.Mutex
+	client   *http.Client
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	key      []byte
+}
+
+// authenticate the visitor by the vhost settings. returns the user name,
+// which is empty if the vhost needs no authentication, and false if the
+// request has been answered, e.g. with 401 or a login redirect.
+func auth_gate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	hc := config.host(r.Host)
+	if hc == nil || hc.Auth == nil {
+		return "", true
+	}
+	a := hc.Auth
+	if a.OIDC != nil {
+		switch r.URL.Path {
+		case AUTH_CALLBACK_PATH:
+			a.OIDC.callback(w, r)
+			return "", false
+		case AUTH_LOGOUT_PATH:
+			a.OIDC.logout(w, r)
+			return "", false
+		}
+	}
+	if a.Htpasswd != "" {
+		if u, p, ok := r.BasicAuth(); ok {
+			if htpasswd_check(a.Htpasswd, u, p) {
+				// hub credentials are not for backends
+				r.Header.Del("Authorization")
+				return u, true
+			}
+			log.Println("bad credentials for", u, "at", r.Host)
+		}
+	}
+	if a.OIDC != nil {
+		if user := a.OIDC.session(r); user != "" {
+			return user, true
+		}
+		a.OIDC.login(w, r)
+		return "", false
+	}
+	realm := a.Realm
+	if realm == "" {
+		realm = r.Host
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return "", false
+}
+
+// drop cookies of the hub from the request before forwarding
+func strip_hub_cookies(r *http.Request) {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != SESSION_COOKIE && c.Name != STATE_COOKIE {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// ==== OpenID Connect
+
+// discover the issuer on first use, so the hub starts without it
+func (oc *OIDCConfig) init() error {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.provider != nil {
+		return nil
+	}
+	if oc.key == nil {
+		if oc.CookieSecret != "" {
+			sum := sha256.Sum256([]byte(oc.CookieSecret))
+			oc.key = sum[:]
+		} else {
+			oc.key = make([]byte, 32)
+			if _, err := rand.Read(oc.key); err != nil {
+				return err
+			}
+		}
+	}
+	oc.client = http.DefaultClient
+	if oc.IssuerCA != "" {
+		pem, err := ioutil.ReadFile(oc.IssuerCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certs in " + oc.IssuerCA)
+		}
+		oc.client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	p, err := oidc.NewProvider(oc.context(), oc.Issuer)
+	if err != nil {
+		return err
+	}
+	oc.provider = p
+	oc.verifier = p.Verifier(&oidc.Config{ClientID: oc.ClientID})
+	return nil
+}
+
+// context for calls to the issuer
+func (oc *OIDCConfig) context() context.Context {
+	return oidc.ClientContext(context.Background(), oc.client)
+}
+
+// OAuth2 config for the request's vhost
+func (oc *OIDCConfig) oauth2(r *http.Request) *oauth2.Config {
+	redirect := oc.RedirectURL
+	if redirect == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		redirect = scheme + "://" + r.Host + AUTH_CALLBACK_PATH
+	}
+	return &oauth2.Config{
+		ClientID:     oc.ClientID,
+		ClientSecret: oc.ClientSecret,
+		Endpoint:     oc.provider.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       append([]string{oidc.ScopeOpenID}, oc.Scopes...),
+	}
+}
+
+// the user of a valid session cookie, empty if none
+func (oc *OIDCConfig) session(r *http.Request) string {
+	c, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return ""
+	}
+	if err = oc.init(); err != nil {
+		log.Println("error oidc:", err)
+		return ""
+	}
+	v, ok := verify_value(oc.key, c.Value)
+	if !ok {
+		return ""
+	}
+	// value is "expiry|vhost|user", sessions of other vhosts, even with
+	// the same secret, don't count
+	parts := strings.SplitN(v, "|", 3)
+	if len(parts) != 3 || parts[1] != strings.ToLower(r.Host) {
+		return ""
+	}
+	if exp, err := strconv.ParseInt(parts[0], 10, 64); err != nil || time.Now().Unix() > exp {
+		return ""
+	}
+	strip_hub_cookies(r)
+	return parts[2]
+}
+
+// send visitor to the issuer to log in
+func (oc *OIDCConfig) login(w http.ResponseWriter, r *http.Request) {
+	if err := oc.init(); err != nil {
+		log.Println("error oidc:", err)
+		http.Error(w, "Login unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// only page navigations can follow the login redirects
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	state, nonce := random_token(), random_token()
+	// pending login is "expiry|state|nonce|return path"
+	exp := strconv.FormatInt(time.Now().Unix()+LOGIN_SECS, 10)
+	v := exp + "|" + state + "|" + nonce + "|" + r.URL.RequestURI()
+	http.SetCookie(w, &http.Cookie{
+		Name:     STATE_COOKIE,
+		Value:    sign_value(oc.key, v),
+		Path:     "/",
+		MaxAge:   LOGIN_SECS,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	url := oc.oauth2(r).AuthCodeURL(state, oidc.Nonce(nonce))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// finish login with the code from the issuer and start the session
+func (oc *OIDCConfig) callback(w http.ResponseWriter, r *http.Request) {
+	if err := oc.init(); err != nil {
+		log.Println("error oidc:", err)
+		http.Error(w, "Login unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	c, err := r.Cookie(STATE_COOKIE)
+	if err != nil {
+		http.Error(w, "Missing login state", http.StatusBadRequest)
+		return
+	}
+	v, ok := verify_value(oc.key, c.Value)
+	parts := strings.SplitN(v, "|", 4)
+	if !ok || len(parts) != 4 {
+		http.Error(w, "Bad login state", http.StatusBadRequest)
+		return
+	}
+	exp, _ := strconv.ParseInt(parts[0], 10, 64)
+	q := r.URL.Query()
+	if time.Now().Unix() > exp || q.Get("state") != parts[1] {
+		http.Error(w, "Bad login state", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		log.Println("oidc login error:", e, q.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	tok, err := oc.oauth2(r).Exchange(oc.context(), q.Get("code"))
+	if err != nil {
+		log.Println("error oidc exchange:", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	raw, _ := tok.Extra("id_token").(string)
+	idt, err := oc.verifier.Verify(oc.context(), raw)
+	if err != nil || idt.Nonce != parts[2] {
+		log.Println("error oidc id token:", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err = idt.Claims(&claims); err != nil {
+		log.Println("error oidc claims:", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	// only verified emails name the user, anyone could claim others
+	user := idt.Subject
+	if claims.Email != "" && claims.EmailVerified {
+		user = claims.Email
+	}
+	if len(oc.Users) > 0 && !has_fold(oc.Users, user) {
+		log.Println("oidc user not allowed:", user)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	secs := oc.SessionSecs
+	if secs <= 0 {
+		secs = SESSION_SECS
+	}
+	sv := strconv.FormatInt(time.Now().Unix()+int64(secs), 10) + "|" + strings.ToLower(r.Host) + "|" + user
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    sign_value(oc.key, sv),
+		Path:     "/",
+		MaxAge:   secs,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: STATE_COOKIE, Path: "/", MaxAge: -1})
+	log.Println("oidc login:", user, "at", r.Host)
+	// only return to local paths
+	back := parts[3]
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		back = "/"
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// drop the session, only by POST so other sites can't log visitors out
+func (oc *OIDCConfig) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// whether the list has the string, ignoring case
+func has_fold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// random URL safe token
+func random_token() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign the value into a cookie safe string
+func sign_value(key []byte, v string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(v))
+	return base64.RawURLEncoding.EncodeToString([]byte(v)) + "." +
+		base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// verify a signed string, returns the value and whether it is genuine
+func verify_value(key []byte, s string) (string, bool) {
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 {
+		return "", false
+	}
+	v, err := base64.RawURLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil {
+		return "", false
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(v)
+	if !hmac.Equal(sig, m.Sum(nil)) {
+		return "", false
+	}
+	return string(v), true
+}
+
+// ==== htpasswd
+
+// a loaded htpasswd file
+type htpasswd struct {
+	mtime time.Time
+	users map[string]string // user -> hash
+}
+
+var (
+	htpasswd_mu    sync.Mutex
+	htpasswd_files = make(map[string]*htpasswd)
+)
+
+// check the credentials against the htpasswd file, which is reloaded
+// when changed. bcrypt, apr1 (MD5) and SHA1 hashes are supported.
+func htpasswd_check(file, user, password string) bool {
+	fi, err := os.Stat(file)
+	if err != nil {
+		log.Println("error htpasswd:", err)
+		return false
+	}
+	htpasswd_mu.Lock()
+	hp, ok := htpasswd_files[file]
+	if !ok || !hp.mtime.Equal(fi.ModTime()) {
+		if hp, err = load_htpasswd(file); err != nil {
+			htpasswd_mu.Unlock()
+			log.Println("error htpasswd:", err)
+			return false
+		}
+		hp.mtime = fi.ModTime()
+		htpasswd_files[file] = hp
+	}
+	hash, ok := hp.users[user]
+	htpasswd_mu.Unlock()
+	return ok && check_hash(hash, password)
+}
+
+// read "user:hash" lines
+func load_htpasswd(file string) (*htpasswd, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hp := &htpasswd{users: make(map[string]string)}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			hp.users[line[:i]] = line[i+1:]
+		}
+	}
+	return hp, s.Err()
+}
+
+// check password against htpasswd hash
+func check_hash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		b64 := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(b64)) == 1
+	case strings.HasPrefix(hash, APR1_MAGIC):
+		salt := strings.SplitN(hash[len(APR1_MAGIC):], "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+	log.Println("unsupported htpasswd hash")
+	return false
+}
+
+// magic prefix of Apache MD5 hashes
+const APR1_MAGIC = "$apr1$"
+
+// Apache variant of MD5 crypt, the default hash of htpasswd
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(APR1_MAGIC + salt))
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	sum := alt.Sum(nil)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(sum)
+		} else {
+			ctx.Write(sum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum = ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pw)
+		}
+		sum = c.Sum(nil)
+	}
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := []byte(APR1_MAGIC + salt + "$")
+	enc := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		enc(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	enc(uint32(sum[11]), 2)
+	return string(out)
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_htpasswd(t *testing.T) {
+	// apr1, SHA1 and bcrypt hashes of "password"
+	file := filepath.Join(t.TempDir(), "users")
+	ioutil.WriteFile(file, []byte(`# test users
+apr:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1
+sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+bc:$2y$05$oE0TnGQRIXpfx08VH.hPEuhaq/L6jEcyhYb8Je0Q2h7AufwvVXgZu
+`), 0600)
+
+	for _, c := range []struct {
+		user, pw string
+		ok       bool
+	}{
+		{"apr", "password", true},
+		{"apr", "Password", false},
+		{"sha", "password", true},
+		{"sha", "wrong", false},
+		{"bc", "password", true},
+		{"bc", "", false},
+		{"nobody", "password", false},
+	} {
+		if ok := htpasswd_check(file, c.user, c.pw); ok != c.ok {
+			t.Errorf("%s/%s: expected %v", c.user, c.pw, c.ok)
+		}
+	}
+
+	// basic auth gate
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Hosts: map[string]*HostConfig{
+		"wiki.test": {Auth: &AuthConfig{Htpasswd: file}}}}
+
+	r := httptest.NewRequest("GET", "http://wiki.test/", nil)
+	w := httptest.NewRecorder()
+	if _, ok := auth_gate(w, r); ok || w.Code != 401 ||
+		w.Header().Get("WWW-Authenticate") != `Basic realm="wiki.test"` {
+		t.Error("expected basic challenge, got", w.Code, w.Header())
+	}
+	r.SetBasicAuth("apr", "password")
+	if user, ok := auth_gate(httptest.NewRecorder(), r); !ok || user != "apr" {
+		t.Error("expected user apr, got", user, ok)
+	}
+	if r.Header.Get("Authorization") != "" {
+		t.Error("credentials should not be forwarded")
+	}
+	r = httptest.NewRequest("GET", "http://open.test/", nil)
+	if user, ok := auth_gate(httptest.NewRecorder(), r); !ok || user != "" {
+		t.Error("expected open vhost, got", user, ok)
+	}
+}
+
+// a stand-in OpenID Connect issuer
+func test_idp(t *testing.T, verified bool) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	nonces := make(map[string]string) // code -> nonce
+	var idp *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/auth",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{
+			map[string]string{"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+				"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	})
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		nonces["c1"] = q.Get("nonce")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=c1&state="+
+			url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss": idp.URL, "aud": "webx", "sub": "u1",
+			"email": "alice@example.com", "email_verified": verified,
+			"nonce": nonces[r.Form.Get("code")],
+			"iat":   time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		})
+		head := b64([]byte(`{"alg":"RS256","kid":"k1","typ":"JWT"}`))
+		signed := head + "." + b64(claims)
+		sum := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at", "token_type": "Bearer", "expires_in": 60,
+			"id_token": signed + "." + b64(sig),
+		})
+	})
+	idp = httptest.NewServer(mux)
+	return idp
+}
+
+func Test_oidc(t *testing.T) {
+	idp := test_idp(t, true)
+	defer idp.Close()
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Hosts: map[string]*HostConfig{
+		"app.test": {Auth: &AuthConfig{OIDC: &OIDCConfig{
+			Issuer: idp.URL, ClientID: "webx", ClientSecret: "s",
+			CookieSecret: "secret", Users: []string{"Alice@Example.com"}}}},
+		"other.test": {Auth: &AuthConfig{OIDC: &OIDCConfig{
+			Issuer: idp.URL, ClientID: "webx", ClientSecret: "s", CookieSecret: "secret"}}}}}
+
+	// unauthenticated page view is sent to the issuer
+	r := httptest.NewRequest("GET", "http://app.test/page?x=1", nil)
+	w := httptest.NewRecorder()
+	if _, ok := auth_gate(w, r); ok || w.Code != http.StatusFound {
+		t.Fatal("expected login redirect, got", w.Code)
+	}
+	state := w.Result().Cookies()[0]
+
+	// the issuer sends the visitor back with a code
+	noredirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	rsp, err := noredirect.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, _ := url.Parse(rsp.Header.Get("Location"))
+	if back.Host != "app.test" || back.Path != AUTH_CALLBACK_PATH {
+		t.Fatal("unexpected callback", back)
+	}
+
+	// callback without the state cookie is refused
+	w = httptest.NewRecorder()
+	auth_gate(w, httptest.NewRequest("GET", back.String(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Error("expected 400 w/o state, got", w.Code)
+	}
+
+	// callback starts the session and returns to the page
+	r = httptest.NewRequest("GET", back.String(), nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	if _, ok := auth_gate(w, r); ok || w.Code != http.StatusFound ||
+		w.Header().Get("Location") != "/page?x=1" {
+		t.Fatal("expected return to page, got", w.Code, w.Header(), w.Body)
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SESSION_COOKIE {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie")
+	}
+
+	// the session passes the gate, hub cookies are not forwarded
+	r = httptest.NewRequest("POST", "http://app.test/api", nil)
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	if user, ok := auth_gate(httptest.NewRecorder(), r); !ok || user != "alice@example.com" {
+		t.Error("expected alice, got", user, ok)
+	}
+	if c := r.Header.Get("Cookie"); c != "app=1" {
+		t.Error("expected only app cookie, got", c)
+	}
+
+	// the session is not for other vhosts of the same secret
+	r = httptest.NewRequest("GET", "http://other.test/page", nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	if _, ok := auth_gate(w, r); ok || w.Code != http.StatusFound {
+		t.Error("expected login at other vhost, got", w.Code)
+	}
+
+	// forged sessions and non-page requests are refused
+	session.Value = sign_value([]byte("other"), "9999999999|app.test|mallory")
+	r = httptest.NewRequest("POST", "http://app.test/api", nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	if _, ok := auth_gate(w, r); ok || w.Code != http.StatusUnauthorized {
+		t.Error("expected 401 for forged session, got", w.Code)
+	}
+
+	// logout only by POST
+	for method, code := range map[string]int{"GET": http.StatusMethodNotAllowed, "POST": http.StatusFound} {
+		w = httptest.NewRecorder()
+		auth_gate(w, httptest.NewRequest(method, "http://app.test"+AUTH_LOGOUT_PATH, nil))
+		if w.Code != code || (code == http.StatusFound) != (len(w.Result().Cookies()) == 1) {
+			t.Error(method, "logout expected", code, "got", w.Code, w.Result().Cookies())
+		}
+	}
+
+	// unverified emails don't name the user, the subject is not allowed
+	unverified := test_idp(t, false)
+	defer unverified.Close()
+	config.Hosts["app.test"].Auth.OIDC = &OIDCConfig{Issuer: unverified.URL, ClientID: "webx",
+		ClientSecret: "s", CookieSecret: "secret", Users: []string{"alice@example.com"}}
+	w = httptest.NewRecorder()
+	auth_gate(w, httptest.NewRequest("GET", "http://app.test/", nil))
+	state = w.Result().Cookies()[0]
+	if rsp, err = noredirect.Get(w.Header().Get("Location")); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", rsp.Header.Get("Location"), nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	if _, ok := auth_gate(w, r); ok || w.Code != http.StatusForbidden {
+		t.Error("expected 403 for unverified email, got", w.Code)
+	}
+}
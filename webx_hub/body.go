@@ -0,0 +1,90 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"github.com/yf13/webswitch"
+)
+
+// bodies of unknown length up to this size are read ahead to learn it
+const BODY_PROBE_BYTES = 64 * 1024
+
+// error of request bodies beyond the limit of their plug
+var errBodyTooLarge = errors.New("request body too large for plug")
+
+// limitBody is a request body of unknown length, failing once it grows
+// beyond the limit of the plug it is sent to
+type limitBody struct {
+	io.Reader
+	io.Closer
+	limit int64 // set by the hub before the plug reads
+	read  int64
+	over  int32 // set once the limit is exceeded
+}
+
+func (lb *limitBody) Read(p []byte) (int, error) {
+	// one byte beyond the limit tells the body goes on
+	if max := lb.limit - lb.read; int64(len(p)) > max {
+		p = p[:max+1]
+	}
+	n, err := lb.Reader.Read(p)
+	lb.read += int64(n)
+	if lb.read > lb.limit {
+		atomic.StoreInt32(&lb.over, 1)
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// whether the body was cut at the limit
+func (lb *limitBody) exceeded() bool {
+	return atomic.LoadInt32(&lb.over) != 0
+}
+
+// whether the request body may be a stream the client expects replies
+// to before it ends, like HTTP/2 bidi and gRPC calls
+func streamed(r *http.Request) bool {
+	return r.ProtoMajor >= 2 || strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// learn the length of the request body if it is unknown but small, or
+// prepare it to be limited by the plug it goes to. streamed bodies are
+// not read ahead. returns the limited body, nil if the length is known.
+func probe_body(r *http.Request) (*limitBody, error) {
+	if r.ContentLength >= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if streamed(r) {
+		lb := &limitBody{Reader: r.Body, Closer: r.Body, limit: math.MaxInt64}
+		r.Body = lb
+		return lb, nil
+	}
+	buf := make([]byte, BODY_PROBE_BYTES)
+	n, err := io.ReadFull(r.Body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// all read, send it with its length
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(buf[:n]))
+		r.ContentLength = int64(n)
+		r.TransferEncoding = nil
+		r.Header.Set(webswitch.HEADER_CONTENT_LEN, strconv.Itoa(n))
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lb := &limitBody{Reader: io.MultiReader(bytes.NewReader(buf), r.Body),
+		Closer: r.Body, limit: math.MaxInt64}
+	r.Body = lb
+	return lb, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_probe_body(t *testing.T) {
+	// small bodies of unknown length get measured
+	r := httptest.NewRequest("POST", "http://www.test/", strings.NewReader("small"))
+	r.ContentLength, r.TransferEncoding = -1, []string{"chunked"}
+	if lb, err := probe_body(r); lb != nil || err != nil || r.ContentLength != 5 ||
+		r.Header.Get("Content-Length") != "5" || r.TransferEncoding != nil {
+		t.Fatal("expected measured body, got", lb, err, r.ContentLength)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != "small" {
+		t.Error("bad body", string(b))
+	}
+
+	// large ones stop at the plug limit
+	big := strings.Repeat("x", BODY_PROBE_BYTES+10)
+	for limit, over := range map[int64]bool{BODY_PROBE_BYTES + 10: false, BODY_PROBE_BYTES + 9: true} {
+		r = httptest.NewRequest("POST", "http://www.test/", strings.NewReader(big))
+		r.ContentLength = -1
+		lb, err := probe_body(r)
+		if lb == nil || err != nil {
+			t.Fatal("expected limited body, got", lb, err)
+		}
+		lb.limit = limit
+		b, err := ioutil.ReadAll(r.Body)
+		if lb.exceeded() != over || (err == errBodyTooLarge) != over || (!over && string(b) != big) {
+			t.Error(limit, "expected exceeded", over, "got", err, len(b))
+		}
+	}
+}
+
+func Test_probe_stream(t *testing.T) {
+	// an h2 echo of lines, replying to each before the body ends
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lb, err := probe_body(r); lb == nil || err != nil {
+			t.Error("expected limited stream, got", lb, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		in := bufio.NewScanner(r.Body)
+		for in.Scan() {
+			io.WriteString(w, in.Text()+"\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	clnt := srv.Client()
+	clnt.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	clnt.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true, NextProtos: []string{"h2"}}
+	clnt.Timeout = 5 * time.Second
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", srv.URL, pr)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		rsp, err := clnt.Do(req)
+		if err != nil {
+			t.Error("error bidi request:", err)
+			pw.Close()
+			return
+		}
+		defer rsp.Body.Close()
+		if rsp.ProtoMajor != 2 {
+			t.Error("expected h2, got", rsp.Proto)
+		}
+		out := bufio.NewReader(rsp.Body)
+		for _, msg := range []string{"ping", "pong"} {
+			io.WriteString(pw, msg+"\n")
+			if line, err := out.ReadString('\n'); line != msg+"\n" {
+				t.Error("expected", msg, "got", line, err)
+			}
+		}
+		pw.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bidi stream stalled")
+	}
+}
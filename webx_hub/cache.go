@@ -0,0 +1,627 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/yf13/webswitch"
+)
+
+// header telling visitors how the cache answered: HIT, MISS, STALE or
+// REVALIDATED
+const HEADER_CACHE = "X-Webx-Cache"
+
+// cache defaults
+const (
+	CACHE_MEM_BYTES  = 16 << 20      // size of memory tier
+	CACHE_MAX_OBJECT = 1 << 20       // largest body to cache
+	CACHE_FILE_EXT   = ".webx-cache" // extension of disk tier files
+)
+
+// CacheConfig enables the response cache of a vhost
+type CacheConfig struct {
+	MemBytes  int64  // size of memory tier, defaults to CACHE_MEM_BYTES
+	DiskBytes int64  // size of disk tier, 0 disables it
+	Dir       string // dir of disk tier files, emptied at start
+	MaxObject int64  // largest body to cache, defaults to CACHE_MAX_OBJECT
+	StaleSecs int    // serve stale entries this long when plugs fail, unless the response sets stale-if-error
+
+	store *CacheStore
+}
+
+// status codes cacheable by default
+var cacheable_codes = map[int]bool{200: true, 203: true, 204: true,
+	300: true, 301: true, 308: true, 404: true, 410: true}
+
+// a cached response. Stored entries are only changed with the store
+// locked, others use copies returned by CacheStore.get.
+type cacheEntry struct {
+	host   string            // vhost in lower case
+	uri    string            // request URI
+	vary   map[string]string // request header values selected by Vary
+	status int
+	header http.Header
+	body   []byte        // body in memory tier
+	file   string        // body file in disk tier
+	size   int64         // body size
+	date   time.Time     // when the response was generated
+	ttl    time.Duration // freshness lifetime
+	stale  time.Duration // how long to serve it stale upon errors
+	elem   *list.Element // position in LRU list of its tier
+}
+
+// age of the entry
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(e.date)
+}
+
+// whether the entry can be served without asking the plug
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.ttl
+}
+
+// whether the entry can be served stale upon errors
+func (e *cacheEntry) usable_stale(now time.Time) bool {
+	return e.age(now) < e.ttl+e.stale
+}
+
+// CacheStore keeps cached responses of a vhost in a memory tier and an
+// optional disk tier, both LRU. It is safe for concurrent use.
+type CacheStore struct {
+	cfg       *CacheConfig
+	mu        sync.Mutex
+	entries   map[string][]*cacheEntry // host+uri -> variants
+	mem       *list.List               // memory tier, newest in front
+	disk      *list.List               // disk tier, newest in front
+	mem_size  int64
+	disk_size int64
+}
+
+// create a cache store, removing disk tier files of earlier runs
+func NewCacheStore(cfg *CacheConfig) (*CacheStore, error) {
+	if cfg.DiskBytes > 0 {
+		if cfg.Dir == "" {
+			return nil, errors.New("cache disk tier needs Dir")
+		}
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return nil, err
+		}
+		old, _ := filepath.Glob(filepath.Join(cfg.Dir, "*"+CACHE_FILE_EXT))
+		for _, f := range old {
+			os.Remove(f)
+		}
+	}
+	return &CacheStore{cfg: cfg, entries: make(map[string][]*cacheEntry),
+		mem: list.New(), disk: list.New()}, nil
+}
+
+// size limits of the store
+func (cs *CacheStore) limits() (mem, object int64) {
+	mem, object = cs.cfg.MemBytes, cs.cfg.MaxObject
+	if mem <= 0 {
+		mem = CACHE_MEM_BYTES
+	}
+	if object <= 0 {
+		object = CACHE_MAX_OBJECT
+	}
+	return
+}
+
+// find the variant matching the request headers, returns a copy of the
+// entry or nil
+func (cs *CacheStore) get(host, uri string, h http.Header) *cacheEntry {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, e := range cs.entries[host+uri] {
+		if vary_match(e.vary, h) {
+			if e.file == "" {
+				cs.mem.MoveToFront(e.elem)
+			} else {
+				cs.disk.MoveToFront(e.elem)
+			}
+			c := *e
+			return &c
+		}
+	}
+	return nil
+}
+
+// store the entry, replacing the variant with same vary values
+func (cs *CacheStore) put(e *cacheEntry) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, v := range cs.entries[e.host+e.uri] {
+		if vary_equal(v.vary, e.vary) {
+			cs.remove(v)
+			break
+		}
+	}
+	key := e.host + e.uri
+	cs.entries[key] = append(cs.entries[key], e)
+	e.elem = cs.mem.PushFront(e)
+	cs.mem_size += e.size
+	cs.evict()
+}
+
+// update the variant of the entry by headers of a 304 response
+func (cs *CacheStore) refresh(e *cacheEntry, h http.Header) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, v := range cs.entries[e.host+e.uri] {
+		if vary_equal(v.vary, e.vary) {
+			header := v.header.Clone()
+			for _, k := range []string{"Cache-Control", "Date", "ETag",
+				"Expires", "Last-Modified", "Vary"} {
+				if vv, ok := h[k]; ok {
+					header[k] = vv
+				}
+			}
+			cc := cache_control(header)
+			now := time.Now()
+			v.header, v.date = header, now.Add(-response_age(header))
+			v.ttl, _ = freshness(header, cc)
+			*e = *v
+			return
+		}
+	}
+}
+
+// remove the entry, the lock must be held
+func (cs *CacheStore) remove(e *cacheEntry) {
+	key := e.host + e.uri
+	vl := cs.entries[key]
+	for i, v := range vl {
+		if v == e {
+			vl = append(vl[:i], vl[i+1:]...)
+			break
+		}
+	}
+	if len(vl) == 0 {
+		delete(cs.entries, key)
+	} else {
+		cs.entries[key] = vl
+	}
+	if e.file == "" {
+		cs.mem.Remove(e.elem)
+		cs.mem_size -= e.size
+	} else {
+		cs.disk.Remove(e.elem)
+		cs.disk_size -= e.size
+		os.Remove(e.file)
+	}
+}
+
+// move least recently used entries beyond limits to disk or drop them,
+// the lock must be held
+func (cs *CacheStore) evict() {
+	limit, _ := cs.limits()
+	for cs.mem_size > limit && cs.mem.Len() > 0 {
+		e := cs.mem.Back().Value.(*cacheEntry)
+		if e.size > cs.cfg.DiskBytes || e.size == 0 {
+			cs.remove(e)
+			continue
+		}
+		f, err := ioutil.TempFile(cs.cfg.Dir, "*"+CACHE_FILE_EXT)
+		if err == nil {
+			_, err = f.Write(e.body)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(f.Name())
+			}
+		}
+		if err != nil {
+			log.Println("error cache spill:", err)
+			cs.remove(e)
+			continue
+		}
+		cs.mem.Remove(e.elem)
+		cs.mem_size -= e.size
+		e.body, e.file = nil, f.Name()
+		e.elem = cs.disk.PushFront(e)
+		cs.disk_size += e.size
+	}
+	for cs.disk_size > cs.cfg.DiskBytes && cs.disk.Len() > 0 {
+		cs.remove(cs.disk.Back().Value.(*cacheEntry))
+	}
+}
+
+// open the body of an entry copy
+func (cs *CacheStore) open(e *cacheEntry) (io.ReadCloser, error) {
+	if e.file == "" {
+		return ioutil.NopCloser(bytes.NewReader(e.body)), nil
+	}
+	// the file is kept by the open handle even if evicted later
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return os.Open(e.file)
+}
+
+// drop entries of the host with URIs starting with the prefix. The host
+// may be a vhost or a host name for all its ports. Returns number dropped.
+func (cs *CacheStore) purge(host, prefix string) int {
+	host = strings.ToLower(host)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	count := 0
+	for _, vl := range cs.entries {
+		// remove changes the list in place
+		for _, e := range append([]*cacheEntry(nil), vl...) {
+			if (e.host == host || host_name(e.host) == host) &&
+				strings.HasPrefix(e.uri, prefix) {
+				cs.remove(e)
+				count += 1
+			}
+		}
+	}
+	return count
+}
+
+// purge all cache stores, see CacheStore.purge
+func purge_cache(host, prefix string) int {
+	count := 0
+	for _, hc := range config.Hosts {
+		if hc.Cache != nil && hc.Cache.store != nil {
+			count += hc.Cache.store.purge(host, prefix)
+		}
+	}
+	return count
+}
+
+// cacheLookup follows a visitor request through the cache. A nil lookup
+// is for requests not using the cache, all its methods do nothing.
+type cacheLookup struct {
+	cs           *CacheStore
+	host         string
+	uri          string
+	header       http.Header // visitor request headers as received
+	head         bool        // HEAD request
+	private      bool        // authenticated request, only public responses are stored
+	hit          *cacheEntry // entry found for the request
+	revalidating bool        // validators of hit have been added to the request
+}
+
+// start the cache lookup of a visitor request, nil if the vhost has no
+// cache or the request can't use it.
+func cache_lookup(r *http.Request, user string) *cacheLookup {
+	hc := config.host(r.Host)
+	if hc == nil || hc.Cache == nil || hc.Cache.store == nil {
+		return nil
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return nil
+	}
+	if _, ok := cache_control(r.Header)["no-store"]; ok {
+		return nil
+	}
+	cl := &cacheLookup{
+		cs:      hc.Cache.store,
+		host:    strings.ToLower(r.Host),
+		uri:     r.URL.RequestURI(),
+		header:  r.Header.Clone(),
+		head:    r.Method == "HEAD",
+		private: user != "" || r.Header.Get("Authorization") != "",
+	}
+	cl.hit = cl.cs.get(cl.host, cl.uri, cl.header)
+	return cl
+}
+
+// answer the visitor with a fresh hit, unless revalidation is asked for
+func (cl *cacheLookup) serve_fresh(w http.ResponseWriter) bool {
+	if cl == nil || cl.hit == nil || !cl.hit.fresh(time.Now()) {
+		return false
+	}
+	if _, ok := cache_control(cl.header)["no-cache"]; ok ||
+		cl.header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	return cl.serve(w, "HIT")
+}
+
+// add validators of a stale hit to the request for the plug, unless the
+// visitor has own conditions
+func (cl *cacheLookup) prepare(r *http.Request) {
+	if cl == nil || cl.hit == nil ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return
+	}
+	if etag := cl.hit.header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+		cl.revalidating = true
+	}
+	if lm := cl.hit.header.Get("Last-Modified"); lm != "" {
+		r.Header.Set("If-Modified-Since", lm)
+		cl.revalidating = true
+	}
+}
+
+// answer the visitor from the cache in place of the plug response, which
+// is nil if none came: the hit refreshed by a 304, or served stale when
+// no plug serves the vhost or the plug fails. returns false if the plug
+// response should be passed on; a 304 for a hit that is gone is made a
+// 502 first.
+func (cl *cacheLookup) serve_response(w http.ResponseWriter, pr *PlugResponse) bool {
+	if cl == nil || cl.hit == nil {
+		return false
+	}
+	if pr == nil || (pr.from_hub() && pr.Resp.StatusCode == http.StatusNotFound) ||
+		pr.Resp.StatusCode >= 500 {
+		if cl.hit.usable_stale(time.Now()) {
+			return cl.serve(w, "STALE")
+		}
+		return false
+	}
+	if cl.revalidating && pr.Resp.StatusCode == http.StatusNotModified {
+		cl.cs.refresh(cl.hit, pr.Resp.Header)
+		if cl.serve(w, "REVALIDATED") {
+			return true
+		}
+		// the hit is gone and the visitor sent no conditions, the 304
+		// becomes a bare 502 of the hub
+		id := webswitch.ResponseId(pr.Resp)
+		pr.Resp.Body.Close()
+		pr.Resp.StatusCode, pr.Resp.Body, pr.Resp.ContentLength = http.StatusBadGateway, http.NoBody, 0
+		pr.Resp.Header = http.Header{}
+		if id != "" {
+			pr.Resp.Header.Set(webswitch.HEADER_REQUEST_ID, id)
+		}
+	}
+	return false
+}
+
+// answer the visitor with the hit
+func (cl *cacheLookup) serve(w http.ResponseWriter, state string) bool {
+	e := cl.hit
+	body, err := cl.cs.open(e)
+	if err != nil {
+		log.Println("error cache open:", err)
+		return false
+	}
+	defer body.Close()
+	log.Println("cache", state, cl.host+cl.uri)
+	h := w.Header()
+	for k, vv := range e.header {
+		// copies, so that writers never change the stored values
+		h[k] = append([]string(nil), vv...)
+	}
+	if id := cl.header.Get(webswitch.HEADER_REQUEST_ID); id != "" {
+		h.Set(webswitch.HEADER_REQUEST_ID, id)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	h.Set(HEADER_CACHE, state)
+	if not_modified(cl.header, e.header) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.WriteHeader(e.status)
+	if !cl.head {
+		io.Copy(w, body)
+	}
+	return true
+}
+
+// mark the plug response as a miss and store it once its body has been
+// read completely, if it is cacheable. Hop headers should be cleaned.
+func (cl *cacheLookup) capture(rsp *http.Response) {
+	if cl == nil {
+		return
+	}
+	rsp.Header.Set(HEADER_CACHE, "MISS")
+	e := cl.entry(rsp)
+	if e == nil {
+		return
+	}
+	if rsp.Body == nil {
+		cl.cs.put(e)
+		return
+	}
+	_, max := cl.cs.limits()
+	rsp.Body = &cacheCapture{ReadCloser: rsp.Body, cs: cl.cs, e: e, max: max}
+}
+
+// make the entry for the response, nil if it must not be stored
+func (cl *cacheLookup) entry(rsp *http.Response) *cacheEntry {
+	_, max := cl.cs.limits()
+	if cl.head || !cacheable_codes[rsp.StatusCode] || rsp.ContentLength > max ||
+		rsp.Trailer != nil || rsp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	cc := cache_control(rsp.Header)
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok || (cl.private && !public && !shared) {
+		return nil
+	}
+	vary := make(map[string]string)
+	for _, line := range rsp.Header["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[name] = strings.Join(cl.header[name], ",")
+			}
+		}
+	}
+	ttl, explicit := freshness(rsp.Header, cc)
+	if !explicit && rsp.Header.Get("ETag") == "" && rsp.Header.Get("Last-Modified") == "" {
+		return nil
+	}
+	stale := time.Duration(cl.cs.cfg.StaleSecs) * time.Second
+	if v, ok := cc["stale-if-error"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil {
+			stale = time.Duration(secs) * time.Second
+		}
+	}
+	_, must := cc["must-revalidate"]
+	_, proxy := cc["proxy-revalidate"]
+	if must || proxy {
+		stale = 0
+	}
+	// the id is of the request filling the cache, not of later hits
+	header := rsp.Header.Clone()
+	header.Del(webswitch.HEADER_REQUEST_ID)
+	return &cacheEntry{
+		host:   cl.host,
+		uri:    cl.uri,
+		vary:   vary,
+		status: rsp.StatusCode,
+		header: header,
+		date:   time.Now().Add(-response_age(rsp.Header)),
+		ttl:    ttl,
+		stale:  stale,
+	}
+}
+
+// response body that stores its entry once read to the end
+type cacheCapture struct {
+	io.ReadCloser
+	cs   *CacheStore
+	e    *cacheEntry
+	buf  bytes.Buffer
+	max  int64
+	done bool // stored or given up
+}
+
+func (cc *cacheCapture) Read(p []byte) (int, error) {
+	n, err := cc.ReadCloser.Read(p)
+	if cc.done {
+		return n, err
+	}
+	cc.buf.Write(p[:n])
+	if int64(cc.buf.Len()) > cc.max {
+		cc.done = true
+		cc.buf = bytes.Buffer{}
+	} else if err == io.EOF {
+		cc.done = true
+		cc.e.body = cc.buf.Bytes()
+		cc.e.size = int64(len(cc.e.body))
+		cc.cs.put(cc.e)
+	} else if err != nil {
+		cc.done = true
+	}
+	return n, err
+}
+
+// parse Cache-Control directives into lower case names and values
+func cache_control(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h["Cache-Control"] {
+		for _, d := range strings.Split(line, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if k != "" {
+				cc[strings.ToLower(k)] = strings.Trim(v, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// freshness lifetime of a response, false if it has no explicit one
+func freshness(h http.Header, cc map[string]string) (time.Duration, bool) {
+	if _, ok := cc["no-cache"]; ok {
+		return 0, true
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || secs < 0 {
+				return 0, true
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			// invalid dates mean already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if ttl := exp.Sub(date); ttl > 0 {
+			return ttl, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// age reported by caches before the hub
+func response_age(h http.Header) time.Duration {
+	secs, err := strconv.ParseInt(h.Get("Age"), 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// whether request headers match vary values of an entry
+func vary_match(vary map[string]string, h http.Header) bool {
+	for k, v := range vary {
+		if strings.Join(h[k], ",") != v {
+			return false
+		}
+	}
+	return true
+}
+
+// whether two sets of vary values are the same
+func vary_equal(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// whether conditions of the request hold for a response with headers h
+func not_modified(req, h http.Header) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lm, err := http.ParseTime(h.Get("Last-Modified"))
+		return err == nil && !lm.After(since)
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"github.com/yf13/webswitch"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a plug response with headers and body
+func test_response(code int, body string, kv ...string) *PlugResponse {
+	rsp := &http.Response{StatusCode: code, Header: http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body))}
+	for i := 0; i+1 < len(kv); i += 2 {
+		rsp.Header.Add(kv[i], kv[i+1])
+	}
+	return &PlugResponse{rsp, make(chan bool, 1)}
+}
+
+// pass a request through the cache as handleClient does, with pr as
+// the plug response if the cache asks for one
+func test_visit(r *http.Request, pr *PlugResponse) (*httptest.ResponseRecorder, *http.Request) {
+	w := httptest.NewRecorder()
+	cl := cache_lookup(r, "")
+	if cl.serve_fresh(w) {
+		return w, nil
+	}
+	cl.prepare(r)
+	if cl.serve_response(w, pr) {
+		return w, r
+	}
+	cl.capture(pr.Resp)
+	for k, vv := range pr.Resp.Header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(pr.Resp.StatusCode)
+	body, _ := ioutil.ReadAll(pr.Resp.Body)
+	w.Write(body)
+	return w, r
+}
+
+func Test_cache(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	cc := &CacheConfig{StaleSecs: 60}
+	cc.store, _ = NewCacheStore(cc)
+	config = &HubConfig{Hosts: map[string]*HostConfig{"www.test": {Cache: cc}}}
+
+	// miss, stored for a minute
+	r := httptest.NewRequest("GET", "http://www.test/a.css", nil)
+	w, _ := test_visit(r, test_response(200, "body-a",
+		"Cache-Control", "max-age=60", "ETag", `"v1"`, webswitch.HEADER_REQUEST_ID, "1"))
+	if w.Header().Get(HEADER_CACHE) != "MISS" || w.Body.String() != "body-a" {
+		t.Fatal("expected miss, got", w.Header(), w.Body)
+	}
+	// fresh hit, plug not asked, with the id of this request
+	r = httptest.NewRequest("GET", "http://www.test/a.css", nil)
+	r.Header.Set(webswitch.HEADER_REQUEST_ID, "2")
+	w, fwd := test_visit(r, nil)
+	if fwd != nil || w.Header().Get(HEADER_CACHE) != "HIT" || w.Body.String() != "body-a" ||
+		w.Header().Get(webswitch.HEADER_REQUEST_ID) != "2" {
+		t.Fatal("expected hit, got", w.Header(), w.Body)
+	}
+	// conditional hit
+	r = httptest.NewRequest("GET", "http://www.test/a.css", nil)
+	r.Header.Set("If-None-Match", `W/"v1"`)
+	if w, _ = test_visit(r, nil); w.Code != http.StatusNotModified {
+		t.Error("expected 304, got", w.Code)
+	}
+	// not stored
+	for _, pr := range []*PlugResponse{
+		test_response(200, "x", "Cache-Control", "no-store"),
+		test_response(200, "x", "Cache-Control", "private, max-age=60"),
+		test_response(200, "x", "Cache-Control", "max-age=60", "Set-Cookie", "a=1"),
+		test_response(200, "x", "Cache-Control", "max-age=60", "Vary", "*"),
+		test_response(200, "x"),
+		test_response(500, "x", "Cache-Control", "max-age=60"),
+	} {
+		test_visit(httptest.NewRequest("GET", "http://www.test/b", nil), pr)
+		if cl := cache_lookup(httptest.NewRequest("GET", "http://www.test/b", nil), ""); cl.hit != nil {
+			t.Error("should not be stored:", pr.Resp.Header)
+		}
+	}
+
+	// variants by Accept-Encoding
+	for _, enc := range []string{"gzip", ""} {
+		r = httptest.NewRequest("GET", "http://www.test/v", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		test_visit(r, test_response(200, "v-"+enc,
+			"Cache-Control", "max-age=60", "Vary", "accept-encoding"))
+	}
+	r = httptest.NewRequest("GET", "http://www.test/v", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	if w, _ = test_visit(r, nil); w.Body.String() != "v-gzip" {
+		t.Error("expected gzip variant, got", w.Body)
+	}
+
+	// stale entry is revalidated, then served stale without plugs
+	test_visit(httptest.NewRequest("GET", "http://www.test/s", nil), test_response(200, "s",
+		"Cache-Control", "max-age=0", "ETag", `"s1"`))
+	w, fwd = test_visit(httptest.NewRequest("GET", "http://www.test/s", nil),
+		test_response(304, "", "Cache-Control", "max-age=0"))
+	if fwd.Header.Get("If-None-Match") != `"s1"` || w.Header().Get(HEADER_CACHE) != "REVALIDATED" ||
+		w.Body.String() != "s" {
+		t.Error("expected revalidated, got", w.Header(), w.Body)
+	}
+	notFound := &PlugResponse{test_response(404, "").Resp, nil}
+	w, _ = test_visit(httptest.NewRequest("GET", "http://www.test/s", nil), notFound)
+	if w.Header().Get(HEADER_CACHE) != "STALE" || w.Body.String() != "s" {
+		t.Error("expected stale, got", w.Header(), w.Body)
+	}
+	// the hit is evicted from disk while it is revalidated
+	r = httptest.NewRequest("GET", "http://www.test/s", nil)
+	cl := cache_lookup(r, "")
+	cl.prepare(r)
+	cc.store.purge("www.test", "/s")
+	cl.hit.file = filepath.Join(t.TempDir(), "missing")
+	pr := test_response(304, "", "ETag", `"s1"`, webswitch.HEADER_REQUEST_ID, "2")
+	if w = httptest.NewRecorder(); cl.serve_response(w, pr) || pr.Resp.StatusCode != http.StatusBadGateway ||
+		pr.Resp.Header.Get("ETag") != "" || webswitch.ResponseId(pr.Resp) != "2" {
+		t.Error("expected bare 502, got", pr.Resp.StatusCode, pr.Resp.Header)
+	}
+
+	// purge by prefix
+	if n := purge_cache("www.test", "/a"); n != 1 {
+		t.Error("expected 1 purged, got", n)
+	}
+	if cl := cache_lookup(httptest.NewRequest("GET", "http://www.test/a.css", nil), ""); cl.hit != nil {
+		t.Error("expected purged")
+	}
+}
+
+func Test_cache_tiers(t *testing.T) {
+	cs, err := NewCacheStore(&CacheConfig{MemBytes: 10, DiskBytes: 10, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range []string{"/1", "/2", "/3"} {
+		cs.put(&cacheEntry{host: "h", uri: uri, body: []byte("12345"), size: 5})
+	}
+	if cs.mem.Len() != 2 || cs.disk.Len() != 1 {
+		t.Fatal("expected 2 in memory, 1 on disk, got", cs.mem.Len(), cs.disk.Len())
+	}
+	e := cs.get("h", "/1", nil)
+	if e == nil || e.file == "" {
+		t.Fatal("expected /1 on disk")
+	}
+	body, err := cs.open(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(body); string(b) != "12345" {
+		t.Error("bad body from disk:", string(b))
+	}
+	body.Close()
+	for _, uri := range []string{"/4", "/5"} {
+		cs.put(&cacheEntry{host: "h", uri: uri, body: []byte("12345"), size: 5})
+	}
+	if cs.disk_size != 10 || cs.get("h", "/1", nil) != nil {
+		t.Error("expected /1 dropped from disk, size", cs.disk_size)
+	}
+}
+
+func Test_cache_config(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hub.json")
+	ioutil.WriteFile(file, []byte(`{"Hosts": {"www.test": {"Cache": {}},
+		"bad.test": {"Cache": {"DiskBytes": 1}}}}`), 0600)
+	if _, err := LoadConfig(file); err == nil {
+		t.Error("expected error for disk tier without dir")
+	}
+	ioutil.WriteFile(file, []byte(`{"Hosts": {"www.test": {"Cache": {}}}}`), 0600)
+	cfg, err := LoadConfig(file)
+	if err != nil || cfg.host("www.test").Cache.store == nil {
+		t.Error("expected cache store, got", err)
+	}
+}
+
+func Test_cache_header_rules(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	cc := &CacheConfig{}
+	cc.store, _ = NewCacheStore(cc)
+	config = &HubConfig{Hosts: map[string]*HostConfig{"www.test": {Cache: cc}}}
+	hr := &webswitch.HeaderRules{Response: []*webswitch.HeaderRule{{Op: webswitch.HEADER_OP_REPLACE,
+		Name: "Set-Policy", Match: "^(.*)$", Value: "$1; Secure"}}}
+	if err := hr.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	test_visit(httptest.NewRequest("GET", "http://www.test/p", nil), test_response(200, "p",
+		"Cache-Control", "max-age=60", "Set-Policy", "a=1"))
+
+	// rules of the writer leave the cached values alone
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		cl := cache_lookup(httptest.NewRequest("GET", "http://www.test/p", nil), "")
+		if !cl.serve_fresh(&headerWriter{ResponseWriter: w, rules: hr.Response}) {
+			t.Fatal("expected hit")
+		}
+		if v := w.Header().Get("Set-Policy"); v != "a=1; Secure" {
+			t.Error(i, "unexpected header", v)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file name extensions inside the certificate directory. Each published
+// site has a pair like "example.com.crt" and "example.com.key", optionally
+// with a cached DER encoded OCSP response "example.com.ocsp" to staple.
+const (
+	CERT_FILE_EXT = ".crt"
+	KEY_FILE_EXT  = ".key"
+	OCSP_FILE_EXT = ".ocsp"
+)
+
+// a loaded certificate pair with the files it came from
+type certEntry struct {
+	cert   *tls.Certificate
+	files  []string  // crt, key and ocsp files
+	mtime  time.Time // latest modification time of the files
+	expiry time.Time // next update of the stapled OCSP response, if any
+}
+
+// CertStore holds the hub certificates and picks one for each TLS
+// handshake by SNI. Certificates come from the -cert/-key pair and/or
+// a directory of pairs, and changed files are reloaded without restart.
+type CertStore struct {
+	cert_file string // default public cert file
+	key_file  string // default private key file
+	dir       string // directory of certificate pairs
+
+	mu      sync.RWMutex
+	entries map[string]*certEntry       // cert file -> loaded entry
+	names   map[string]*tls.Certificate // lower case DNS name -> cert
+	def     *tls.Certificate            // cert for unknown or missing SNI
+}
+
+// create a cert store and load all certificates once.
+// returns error if no certificate can be loaded at all.
+func NewCertStore(certFile, keyFile, dir string) (*CertStore, error) {
+	cs := &CertStore{
+		cert_file: certFile,
+		key_file:  keyFile,
+		dir:       dir,
+		entries:   make(map[string]*certEntry),
+		names:     make(map[string]*tls.Certificate),
+	}
+	if _, err := cs.reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// list the cert/key pairs to load, the default pair goes first
+func (cs *CertStore) pairs() [][2]string {
+	var pairs [][2]string
+	if cs.cert_file != "" && cs.key_file != "" {
+		pairs = append(pairs, [2]string{cs.cert_file, cs.key_file})
+	}
+	if cs.dir != "" {
+		crts, err := filepath.Glob(filepath.Join(cs.dir, "*"+CERT_FILE_EXT))
+		if err != nil {
+			log.Println("error list certs:", err)
+		}
+		sort.Strings(crts)
+		for _, crt := range crts {
+			key := strings.TrimSuffix(crt, CERT_FILE_EXT) + KEY_FILE_EXT
+			pairs = append(pairs, [2]string{crt, key})
+		}
+	}
+	return pairs
+}
+
+// reload certificates whose files are new or changed since last load,
+// or whose stapled OCSP response has expired. Certificates failing to
+// load keep their former version. returns the number of reloaded pairs.
+func (cs *CertStore) reload() (int, error) {
+	now := time.Now()
+	entries := make(map[string]*certEntry)
+	var order []string
+	changed := 0
+	for _, p := range cs.pairs() {
+		files := []string{p[0], p[1], ocsp_file(p[0])}
+		mtime := latest_mtime(files)
+		cs.mu.RLock()
+		old := cs.entries[p[0]]
+		cs.mu.RUnlock()
+		if old != nil && old.mtime.Equal(mtime) &&
+			(old.expiry.IsZero() || now.Before(old.expiry)) {
+			entries[p[0]] = old
+			order = append(order, p[0])
+			continue
+		}
+		crt, expiry, err := load_pair(p[0], p[1], files[2])
+		if err != nil {
+			log.Printf("error load cert %s: %v", p[0], err)
+			if old != nil {
+				entries[p[0]] = old
+				order = append(order, p[0])
+			}
+			continue
+		}
+		entries[p[0]] = &certEntry{crt, files, mtime, expiry}
+		order = append(order, p[0])
+		changed += 1
+		log.Println("loaded cert", p[0], crt.Leaf.DNSNames)
+	}
+	if len(entries) == 0 {
+		return 0, errors.New("no certificate loaded")
+	}
+
+	// index by names, former pairs win for duplicated names
+	names := make(map[string]*tls.Certificate)
+	for _, f := range order {
+		crt := entries[f].cert
+		for _, n := range cert_names(crt.Leaf) {
+			if _, ok := names[n]; !ok {
+				names[n] = crt
+			}
+		}
+	}
+	cs.mu.Lock()
+	cs.entries = entries
+	cs.names = names
+	cs.def = entries[order[0]].cert
+	cs.mu.Unlock()
+	return changed, nil
+}
+
+// periodically reload changed certificates, never returns
+func (cs *CertStore) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for _ = range time.Tick(interval) {
+		if n, err := cs.reload(); err != nil {
+			log.Println("error reload certs:", err)
+		} else if n > 0 {
+			log.Println(n, "certs reloaded")
+		}
+	}
+}
+
+// select certificate for the TLS handshake by SNI, it tries the exact
+// name, then the wildcard name and finally the default certificate.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if crt := cs.lookup(hello.ServerName); crt != nil {
+		return crt, nil
+	}
+	if crt := cs.default_cert(); crt != nil {
+		return crt, nil
+	}
+	return nil, errors.New("no certificate for " + hello.ServerName)
+}
+
+// find the certificate issued for the given name, either exactly or by
+// wildcard. returns nil if none.
+func (cs *CertStore) lookup(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if crt, ok := cs.names[name]; ok {
+		return crt
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if crt, ok := cs.names["*"+name[i:]]; ok {
+			return crt
+		}
+	}
+	return nil
+}
+
+// the certificate for unknown or missing SNI
+func (cs *CertStore) default_cert() *tls.Certificate {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.def
+}
+
+// the cached OCSP response file of the given cert file
+func ocsp_file(certFile string) string {
+	ext := filepath.Ext(certFile)
+	return strings.TrimSuffix(certFile, ext) + OCSP_FILE_EXT
+}
+
+// latest modification time of given files, missing files are ignored
+func latest_mtime(files []string) time.Time {
+	var t time.Time
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// lower case names served by the certificate
+func cert_names(leaf *x509.Certificate) []string {
+	src := leaf.DNSNames
+	if len(src) == 0 && leaf.Subject.CommonName != "" {
+		src = []string{leaf.Subject.CommonName}
+	}
+	names := make([]string, len(src))
+	for i, n := range src {
+		names[i] = strings.ToLower(n)
+	}
+	return names
+}
+
+// load a certificate pair and staple the cached OCSP response if it is
+// still good. returns the certificate and next update time of the staple.
+func load_pair(certFile, keyFile, ocspFile string) (*tls.Certificate, time.Time, error) {
+	var expiry time.Time
+	crt, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, expiry, err
+	}
+	if crt.Leaf == nil {
+		if crt.Leaf, err = x509.ParseCertificate(crt.Certificate[0]); err != nil {
+			return nil, expiry, err
+		}
+	}
+	der, err := ioutil.ReadFile(ocspFile)
+	if err != nil {
+		// no cached OCSP response, nothing to staple
+		return &crt, expiry, nil
+	}
+	var issuer *x509.Certificate
+	if len(crt.Certificate) > 1 {
+		issuer, _ = x509.ParseCertificate(crt.Certificate[1])
+	}
+	rsp, err := ocsp.ParseResponseForCert(der, crt.Leaf, issuer)
+	switch {
+	case err != nil:
+		log.Printf("error ocsp %s: %v", ocspFile, err)
+	case rsp.Status != ocsp.Good:
+		log.Printf("ocsp %s: bad status %d", ocspFile, rsp.Status)
+	case !rsp.NextUpdate.IsZero() && time.Now().After(rsp.NextUpdate):
+		log.Printf("ocsp %s: expired at %v", ocspFile, rsp.NextUpdate)
+	default:
+		crt.OCSPStaple = der
+		expiry = rsp.NextUpdate
+	}
+	return &crt, expiry, nil
+}
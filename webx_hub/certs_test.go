@@ -0,0 +1,119 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a self-signed pair for given names as dir/base.crt and dir/base.key
+func write_test_pair(t *testing.T, dir, base string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	kpem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	if err = ioutil.WriteFile(filepath.Join(dir, base+CERT_FILE_EXT), crt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, base+KEY_FILE_EXT), kpem, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the first name of the certificate selected for given SNI
+func sni_name(t *testing.T, cs *CertStore, sni string) string {
+	crt, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatal("no cert for", sni, err)
+	}
+	return crt.Leaf.DNSNames[0]
+}
+
+func Test_certs(t *testing.T) {
+	dir := t.TempDir()
+
+	// empty dir is an error
+	if _, err := NewCertStore("", "", dir); err == nil {
+		t.Error("expected error for empty dir")
+	}
+
+	write_test_pair(t, dir, "a", "a.example.com")
+	write_test_pair(t, dir, "b", "b.example.com", "*.b.example.com")
+	cs, err := NewCertStore("", "", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sni, want := range map[string]string{
+		"a.example.com":     "a.example.com",
+		"B.Example.com.":    "b.example.com",
+		"www.b.example.com": "b.example.com",
+		"other.com":         "a.example.com", // default is the first pair
+		"":                  "a.example.com",
+	} {
+		if got := sni_name(t, cs, sni); got != want {
+			t.Errorf("sni %q: expected %s got %s", sni, want, got)
+		}
+	}
+
+	// nothing changed, nothing reloaded
+	if n, err := cs.reload(); n != 0 || err != nil {
+		t.Error("expected 0 reloads, got", n, err)
+	}
+
+	// rotate pair "a" to a new name
+	write_test_pair(t, dir, "a", "c.example.com")
+	later := time.Now().Add(time.Second)
+	for _, ext := range []string{CERT_FILE_EXT, KEY_FILE_EXT} {
+		os.Chtimes(filepath.Join(dir, "a"+ext), later, later)
+	}
+	if n, err := cs.reload(); n != 1 || err != nil {
+		t.Error("expected 1 reload, got", n, err)
+	}
+	if got := sni_name(t, cs, "c.example.com"); got != "c.example.com" {
+		t.Error("expected rotated cert, got", got)
+	}
+	if got := sni_name(t, cs, "a.example.com"); got != "c.example.com" {
+		t.Error("expected default cert for dropped name, got", got)
+	}
+
+	// a broken pair keeps its former version
+	ioutil.WriteFile(filepath.Join(dir, "b"+KEY_FILE_EXT), []byte("junk"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(filepath.Join(dir, "b"+KEY_FILE_EXT), later, later)
+	cs.reload()
+	if got := sni_name(t, cs, "b.example.com"); got != "b.example.com" {
+		t.Error("expected former cert kept, got", got)
+	}
+}
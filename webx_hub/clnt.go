@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package main
+package webx_hub
 
 import (
 	"io"
@@ -18,24 +18,201 @@ import (
 func handleClient(w http.ResponseWriter, r *http.Request) {
 	defer log.Println("- handleClient")
 	log.Println("+ handleClient")
+	// identities only come from the hub itself
+	r.Header.Del(webswitch.HEADER_IDENTITY)
+	r.Header.Del(webswitch.HEADER_TUNNEL)
+	// the id goes with every answer, denials included, to correlate logs
+	id := next_req_id()
+	r.Header.Set(webswitch.HEADER_REQUEST_ID, id)
+	// tunneled services are not for HTTP visitors
+	if config.tunneled(r.Host) {
+		http.NotFound(w, r)
+		return
+	}
+	// tell real hosts about the visitor
+	forward_headers(r)
+	// rewrite headers by the vhost rules, for all responses
+	if hc := config.host(r.Host); hc != nil && hc.Headers != nil {
+		webswitch.ApplyHeaderRules(hc.Headers.Request, r.Header)
+		w = &headerWriter{ResponseWriter: w, rules: hc.Headers.Response}
+	}
+	ep := error_page(r)
+	// deny clients by access rules
+	if !access_allowed(r) {
+		ep.send(w, http.StatusForbidden, id)
+		log.Printf("access denied req#%s %s %s", id, r.Host, client_ip(r))
+		return
+	}
+	// deny too frequent requests before bothering the hub
+	if ok, wait := limiter.allow_client(r); !ok {
+		w.Header().Set("Retry-After", retry_after(wait))
+		ep.send(w, http.StatusTooManyRequests, id)
+		log.Printf("rate limited req#%s %s %s", id, r.Host, client_ip(r))
+		return
+	}
+	// authenticate visitors of protected vhosts
+	user, ok := auth_gate(w, r)
+	if !ok {
+		log.Println("unauthenticated", r.Host, r.URL.Path)
+		return
+	}
+	if user != "" {
+		log.Println("user", user, "at", r.Host)
+	}
+	// compress responses as the vhost and the visitor allow
+	if cw := compress_writer(w, r); cw != nil {
+		defer cw.Close()
+		w = cw
+	}
+	// answer fresh responses from the cache, or ask to revalidate
+	cl := cache_lookup(r, user)
+	if cl.serve_fresh(w) {
+		return
+	}
+	// share the response of an identical request in flight
+	fl, lead := flights.join(r, user)
+	if fl != nil && !lead && fl.replay(w, r) {
+		log.Println("coalesced", r.Host, r.URL.Path)
+		return
+	}
+	var rec *flightRecorder
+	if lead {
+		rec = fl.record(w)
+		defer flights.finish(fl, rec)
+		w = rec
+	}
+	// read bodies ahead as the vhost asks, so plugs don't wait for visitors
+	sc := config.spool(r.Host)
+	if sc != nil && sc.Requests {
+		if err := sc.spool_request(r); err != nil {
+			ep.send(w, spool_status(err), id)
+			log.Println("error spool req:", err)
+			return
+		}
+		defer r.Body.Close()
+	}
+	// learn the length of small bodies of unknown length, larger ones
+	// are limited by the plug they go to
+	lb, err := probe_body(r)
+	if err != nil {
+		ep.send(w, http.StatusBadRequest, id)
+		log.Println("error read body:", err)
+		return
+	}
+	cl.prepare(r)
 	ch := make(chan *PlugResponse)
 	// forward request to proxy
-	hub.req_queue <- &ClientRequest{r, ch}
+	hub.req_queue <- &ClientRequest{r, ch, user}
 	log.Println("sent req to hub")
 	r = nil // forget client request
 	// wait for response from switch
 	if pr, ok := <-ch; ok {
 		log.Println("rcvd hub response")
+		// the plug got a cut body, whatever it answers
+		if lb != nil && lb.exceeded() {
+			pr.Close()
+			ep.send(w, http.StatusRequestEntityTooLarge, webswitch.ResponseId(pr.Resp))
+			log.Println("too big body for plug")
+			return
+		}
+		// revalidated or stale cache entries replace the response
+		if cl.serve_response(w, pr) {
+			pr.Close()
+			return
+		}
 		// clear rsp headers before answering client
 		webswitch.CleanHopHeaders(&(pr.Resp.Header))
+		// trailers are sent after body by their prefixed names
+		pr.Resp.Header.Del("Trailer")
 		webswitch.CopyHeader(w.Header(), pr.Resp.Header)
+		// bare errors of hub and plugs get pages of the vhost
+		if pr.Resp.StatusCode >= 400 && bodyless(pr.Resp) &&
+			ep.write(w, pr.Resp.StatusCode, webswitch.ResponseId(pr.Resp)) {
+			pr.Close()
+			return
+		}
+		// free the plug link before the visitor reads
+		if sc != nil && sc.Responses {
+			if err := sc.spool_response(pr); err != nil {
+				pr.Close()
+				ep.send(w, http.StatusBadGateway, webswitch.ResponseId(pr.Resp))
+				log.Println("error spool rsp:", err)
+				return
+			}
+		}
+		cl.capture(pr.Resp)
 		w.WriteHeader(pr.Resp.StatusCode)
 		if nil != pr.Resp.Body {
 			// copy body
-			n, err := io.Copy(w, pr.Resp.Body)
+			n, err := flush_copy(w, pr.Resp.Body)
 			log.Printf("sent %d to clnt, err=%v", n, err)
+			if err != nil {
+				rec.fail()
+			}
+		}
+		for k, vv := range pr.Resp.Trailer {
+			for _, v := range vv {
+				w.Header().Add(http.TrailerPrefix+k, v)
+			}
 		}
 		pr.Close()
-		// ignore trailers for now
+	} else if !cl.serve_response(w, nil) {
+		ep.send(w, http.StatusBadGateway, id)
+	}
+}
+
+// headerWriter applies response header rules when headers are written
+type headerWriter struct {
+	http.ResponseWriter
+	rules []*webswitch.HeaderRule
+	wrote bool
+}
+
+func (hw *headerWriter) WriteHeader(code int) {
+	if !hw.wrote {
+		hw.wrote = true
+		webswitch.ApplyHeaderRules(hw.rules, hw.Header())
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if !hw.wrote {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerWriter) Flush() {
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// copy body to the client and flush whatever has been read, so streamed
+// responses such as gRPC or server-sent events reach clients promptly.
+func flush_copy(w http.ResponseWriter, r io.Reader) (int64, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return io.Copy(w, r)
+	}
+	var written int64
+	buf := make([]byte, webswitch.STREAM_SEGMENT_SIZE)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			f.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
 	}
 }
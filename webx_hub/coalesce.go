@@ -0,0 +1,199 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"github.com/yf13/webswitch"
+)
+
+// limits of coalescing
+const (
+	COALESCE_MAX_BODY = 1 << 20          // largest response body to share
+	COALESCE_WAIT     = 30 * time.Second // followers forward themselves after this
+)
+
+// request headers that must be identical for requests to coalesce,
+// besides those named by Vary of the response
+var coalesce_headers = []string{"Accept", "Accept-Encoding", "Accept-Language",
+	"Authorization", "Cookie", "Cache-Control", "If-None-Match",
+	"If-Modified-Since", "Range"}
+
+// a request in flight that identical requests wait for
+type flight struct {
+	key    string
+	req    http.Header   // request headers of the leader
+	done   chan struct{} // closed when the leader has answered
+	shared bool          // whether the response can be shared
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Coalescer keeps requests in flight by their keys, so identical GETs
+// to vhosts with Coalesce set are forwarded once while the others wait
+// and get the same response. It is safe for concurrent use.
+type Coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// the coalescer of the hub
+var flights = &Coalescer{}
+
+// join the flight of an identical request, or start a new one. returns
+// nil if the request can't be coalesced, and true if it leads the flight.
+func (co *Coalescer) join(r *http.Request, user string) (*flight, bool) {
+	hc := config.host(r.Host)
+	if hc == nil || !hc.Coalesce || r.Method != "GET" ||
+		r.ContentLength != 0 || len(r.TransferEncoding) > 0 {
+		return nil, false
+	}
+	key := coalesce_key(r, user)
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if fl, ok := co.flights[key]; ok {
+		return fl, false
+	}
+	if co.flights == nil {
+		co.flights = make(map[string]*flight)
+	}
+	fl := &flight{key: key, req: r.Header.Clone(), done: make(chan struct{})}
+	co.flights[key] = fl
+	return fl, true
+}
+
+// end the flight with the response recorded for the leader
+func (co *Coalescer) finish(fl *flight, fr *flightRecorder) {
+	co.mu.Lock()
+	delete(co.flights, fl.key)
+	co.mu.Unlock()
+	fl.status, fl.header, fl.body = fr.status, fr.header, fr.body.Bytes()
+	fl.shared = fr.shareable()
+	close(fl.done)
+}
+
+// key of identical requests
+func coalesce_key(r *http.Request, user string) string {
+	parts := []string{strings.ToLower(r.Host), r.URL.RequestURI(), user}
+	for _, h := range coalesce_headers {
+		parts = append(parts, strings.Join(r.Header[h], ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// wait for the leader and answer the visitor with its response. returns
+// false if it can't be shared, so the request should be forwarded.
+func (fl *flight) replay(w http.ResponseWriter, r *http.Request) bool {
+	select {
+	case <-fl.done:
+	case <-time.After(COALESCE_WAIT):
+		return false
+	}
+	if !fl.shared {
+		return false
+	}
+	// headers named by Vary must match those of the leader
+	for _, line := range fl.header["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" || strings.Join(r.Header[name], ",") !=
+				strings.Join(fl.req[name], ",") {
+				return false
+			}
+		}
+	}
+	h := w.Header()
+	for k, vv := range fl.header {
+		// copies, so that writers never change the stored values
+		h[k] = append([]string(nil), vv...)
+	}
+	// each visitor keeps its own request id
+	h.Del(webswitch.HEADER_REQUEST_ID)
+	if id := webswitch.RequestId(r); id != "" {
+		h.Set(webswitch.HEADER_REQUEST_ID, id)
+	}
+	w.WriteHeader(fl.status)
+	w.Write(fl.body)
+	return true
+}
+
+// start recording the response to the leader
+func (fl *flight) record(w http.ResponseWriter) *flightRecorder {
+	return &flightRecorder{ResponseWriter: w}
+}
+
+// flightRecorder passes the response to the leader's visitor and keeps
+// a copy for the followers
+type flightRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header // headers when written
+	body   bytes.Buffer
+	broken bool // body incomplete or too big
+}
+
+func (fr *flightRecorder) WriteHeader(code int) {
+	if fr.status == 0 {
+		fr.status = code
+		fr.header = fr.ResponseWriter.Header().Clone()
+	}
+	fr.ResponseWriter.WriteHeader(code)
+}
+
+func (fr *flightRecorder) Write(p []byte) (int, error) {
+	if fr.status == 0 {
+		fr.WriteHeader(http.StatusOK)
+	}
+	if !fr.broken {
+		fr.body.Write(p)
+		if fr.body.Len() > COALESCE_MAX_BODY {
+			fr.fail()
+		}
+	}
+	n, err := fr.ResponseWriter.Write(p)
+	if err != nil {
+		fr.fail()
+	}
+	return n, err
+}
+
+func (fr *flightRecorder) Flush() {
+	if f, ok := fr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// mark the recorded response as not to be shared, nil safe
+func (fr *flightRecorder) fail() {
+	if fr != nil {
+		fr.broken = true
+		fr.body = bytes.Buffer{}
+	}
+}
+
+// whether the recorded response can be given to other visitors
+func (fr *flightRecorder) shareable() bool {
+	if fr.broken || fr.status == 0 || fr.header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := cache_control(fr.header)
+	_, private := cc["private"]
+	_, nostore := cc["no-store"]
+	if private || nostore {
+		return false
+	}
+	// trailers are only known after the body
+	for k := range fr.ResponseWriter.Header() {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return false
+		}
+	}
+	return true
+}
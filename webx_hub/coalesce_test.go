@@ -0,0 +1,105 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"github.com/yf13/webswitch"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_coalesce(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Hosts: map[string]*HostConfig{"www.test": {Coalesce: true}}}
+
+	// a leader and followers of the same page, one differs by Accept-Language
+	r := httptest.NewRequest("GET", "http://www.test/page", nil)
+	fl, lead := flights.join(r, "")
+	if fl == nil || !lead {
+		t.Fatal("expected leader")
+	}
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 3)
+	replayed := make([]bool, 3)
+	for i := range results {
+		fr := httptest.NewRequest("GET", "http://www.test/page", nil)
+		fr.Header.Set(webswitch.HEADER_REQUEST_ID, strconv.Itoa(i+2))
+		if i == 2 {
+			fr.Header.Set("Accept-Language", "fr")
+		}
+		f, lead := flights.join(fr, "")
+		if i < 2 && (f != fl || lead) {
+			t.Fatal("expected follower", i)
+		}
+		if i == 2 {
+			if f == fl || !lead {
+				t.Fatal("expected own flight for other language")
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = httptest.NewRecorder()
+			replayed[i] = f.replay(results[i], fr)
+		}(i)
+	}
+
+	w := httptest.NewRecorder()
+	rec := fl.record(w)
+	rec.Header().Set("Content-Type", "text/plain")
+	rec.Header().Set(webswitch.HEADER_REQUEST_ID, "1")
+	rec.WriteHeader(200)
+	rec.Write([]byte("hello"))
+	flights.finish(fl, rec)
+	wg.Wait()
+	for i := 0; i < 2; i++ {
+		if !replayed[i] || results[i].Body.String() != "hello" ||
+			results[i].Header().Get("Content-Type") != "text/plain" ||
+			webswitch.ResponseId(&http.Response{Header: results[i].Header()}) != strconv.Itoa(i+2) {
+			t.Error("follower", i, "got", replayed[i], results[i].Body)
+		}
+	}
+	if w.Body.String() != "hello" {
+		t.Error("leader got", w.Body)
+	}
+
+	// personal or failed responses are not shared
+	for _, c := range []struct {
+		kv   []string
+		fail bool
+	}{
+		{[]string{"Set-Cookie", "id=1"}, false},
+		{[]string{"Cache-Control", "private"}, false},
+		{nil, true},
+	} {
+		fl, _ = flights.join(httptest.NewRequest("GET", "http://www.test/p", nil), "")
+		f, _ := flights.join(httptest.NewRequest("GET", "http://www.test/p", nil), "")
+		rec = fl.record(httptest.NewRecorder())
+		for i := 0; i+1 < len(c.kv); i += 2 {
+			rec.Header().Set(c.kv[i], c.kv[i+1])
+		}
+		rec.Write([]byte("x"))
+		if c.fail {
+			rec.fail()
+		}
+		flights.finish(fl, rec)
+		if f.replay(httptest.NewRecorder(), nil) {
+			t.Error("should not share", c.kv, c.fail)
+		}
+	}
+
+	// only GETs to coalescing vhosts
+	if fl, _ = flights.join(httptest.NewRequest("GET", "http://other.test/", nil), ""); fl != nil {
+		t.Error("other.test should not coalesce")
+	}
+	if fl, _ = flights.join(httptest.NewRequest("POST", "http://www.test/page", nil), ""); fl != nil {
+		t.Error("POST should not coalesce")
+	}
+}
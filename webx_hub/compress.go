@@ -0,0 +1,174 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compression defaults
+const (
+	COMPRESS_MIN_BYTES = 1024 // smallest body of known length to compress
+)
+
+// content types compressed by default, "type/*" matches the whole type
+var COMPRESS_TYPES = []string{"text/*", "application/json",
+	"application/javascript", "application/xml", "application/xhtml+xml",
+	"application/rss+xml", "application/atom+xml", "application/manifest+json",
+	"application/wasm", "image/svg+xml"}
+
+// CompressConfig enables compression of responses to visitors
+type CompressConfig struct {
+	Types    []string // content types to compress, defaults to COMPRESS_TYPES
+	MinBytes int64    // smallest body of known length, defaults to COMPRESS_MIN_BYTES
+	Brotli   bool     // offer brotli besides gzip
+}
+
+// whether responses of the content type are compressed
+func (cc *CompressConfig) compresses(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	types := cc.Types
+	if len(types) == 0 {
+		types = COMPRESS_TYPES
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mt || (strings.HasSuffix(t, "/*") &&
+			strings.HasPrefix(mt, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick the encoding accepted by the visitor, empty if none
+func accept_encoding(h http.Header, br bool) string {
+	best, bestq := "", 0.0
+	for _, line := range h["Accept-Encoding"] {
+		for _, part := range strings.Split(line, ",") {
+			fields := strings.Split(part, ";")
+			enc := strings.ToLower(strings.TrimSpace(fields[0]))
+			q := 1.0
+			for _, p := range fields[1:] {
+				if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+					q, _ = strconv.ParseFloat(v[2:], 64)
+				}
+			}
+			if (enc == "gzip" || (enc == "br" && br)) && q > 0 &&
+				(q > bestq || (q == bestq && enc == "br")) {
+				best, bestq = enc, q
+			}
+		}
+	}
+	return best
+}
+
+// an encoder writing to the visitor
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter compresses the response once its headers show it is
+// worth it. Close must be called after the response is written.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg   *CompressConfig
+	enc   string  // encoding accepted by the visitor
+	zw    encoder // nil if not compressing
+	wrote bool
+}
+
+// wrap the response writer of a visitor request to compress as the
+// vhost and the visitor allow, nil if no compression applies
+func compress_writer(w http.ResponseWriter, r *http.Request) *compressWriter {
+	hc := config.host(r.Host)
+	if hc == nil || hc.Compress == nil || r.Method == "HEAD" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, cfg: hc.Compress,
+		enc: accept_encoding(r.Header, hc.Compress.Brotli)}
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if !cw.wrote {
+		cw.wrote = true
+		cw.start(code)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// decide whether to compress by the response headers
+func (cw *compressWriter) start(code int) {
+	h := cw.Header()
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent || h.Get("Content-Encoding") != "" ||
+		h.Get("Content-Range") != "" || !cw.cfg.compresses(h.Get("Content-Type")) ||
+		strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return
+	}
+	// a new slice, the values may be shared, e.g. by cache entries
+	vary := h["Vary"]
+	h["Vary"] = append(vary[:len(vary):len(vary)], "Accept-Encoding")
+	min := cw.cfg.MinBytes
+	if min <= 0 {
+		min = COMPRESS_MIN_BYTES
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); cw.enc == "" ||
+		(err == nil && n < min) {
+		return
+	}
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", cw.enc)
+	// the encoded body differs from the original
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	if cw.enc == "br" {
+		cw.zw = brotli.NewWriter(cw.ResponseWriter)
+	} else {
+		cw.zw = gzip.NewWriter(cw.ResponseWriter)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wrote {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish the compressed body
+func (cw *compressWriter) Close() error {
+	if cw.zw != nil {
+		return cw.zw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_accept_encoding(t *testing.T) {
+	for _, c := range []struct {
+		ae     string
+		brotli bool
+		enc    string
+	}{
+		{"gzip, deflate, br", true, "br"},
+		{"gzip, deflate, br", false, "gzip"},
+		{"br;q=0.5, gzip", true, "gzip"},
+		{"gzip;q=0, br;q=0", true, ""},
+		{"identity", true, ""},
+		{"", true, ""},
+	} {
+		h := http.Header{"Accept-Encoding": {c.ae}}
+		if enc := accept_encoding(h, c.brotli); enc != c.enc {
+			t.Errorf("%q: expected %q got %q", c.ae, c.enc, enc)
+		}
+	}
+}
+
+func Test_compress(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Hosts: map[string]*HostConfig{
+		"www.test": {Compress: &CompressConfig{Brotli: true}}}}
+	page := strings.Repeat("<p>hello</p>", 200)
+
+	for _, c := range []struct {
+		ae, ct, body, etag string
+		enc                string
+	}{
+		{"gzip", "text/html; charset=utf-8", page, `W/"1"`, "gzip"},
+		{"gzip, br", "text/html", page, `W/"1"`, "br"},
+		{"gzip", "image/png", page, `"1"`, ""},
+		{"gzip", "text/html", "short", `"1"`, ""},
+		{"", "text/html", page, `"1"`, ""},
+	} {
+		r := httptest.NewRequest("GET", "http://www.test/", nil)
+		r.Header.Set("Accept-Encoding", c.ae)
+		w := httptest.NewRecorder()
+		cw := compress_writer(w, r)
+		cw.Header().Set("Content-Type", c.ct)
+		cw.Header().Set("Content-Length", "1")
+		cw.Header().Set("ETag", `"1"`)
+		if len(c.body) > COMPRESS_MIN_BYTES {
+			cw.Header().Del("Content-Length")
+		}
+		cw.WriteHeader(200)
+		io.WriteString(cw, c.body)
+		cw.Close()
+
+		h := w.Header()
+		if h.Get("Content-Encoding") != c.enc || h.Get("ETag") != c.etag {
+			t.Errorf("%s %s: expected %q %s, got %v", c.ae, c.ct, c.enc, c.etag, h)
+			continue
+		}
+		var zr io.Reader = w.Body
+		switch c.enc {
+		case "gzip":
+			zr, _ = gzip.NewReader(w.Body)
+		case "br":
+			zr = brotli.NewReader(w.Body)
+		}
+		if b, _ := ioutil.ReadAll(zr); string(b) != c.body {
+			t.Errorf("%s %s: bad body %q", c.ae, c.ct, b)
+		}
+	}
+
+	// other vhosts and HEAD requests are left alone
+	if compress_writer(nil, httptest.NewRequest("GET", "http://other.test/", nil)) != nil ||
+		compress_writer(nil, httptest.NewRequest("HEAD", "http://www.test/", nil)) != nil {
+		t.Error("expected no compression")
+	}
+}
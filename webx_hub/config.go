@@ -0,0 +1,228 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/yf13/webswitch"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// HostConfig holds settings of one published vhost, unset fields take
+// the global defaults of the hub config.
+type HostConfig struct {
+	Rates    *RateLimits            // request rate limits
+	Access   *AccessRules           // client IP and country rules
+	Auth     *AuthConfig            // visitor authentication
+	Cache    *CacheConfig           // response cache, disabled if nil
+	Coalesce bool                   // forward identical concurrent GETs once, sharing the response
+	Compress *CompressConfig        // gzip/brotli compression of responses, disabled if nil
+	Headers  *webswitch.HeaderRules // request and response header rules
+	Errors   *ErrorPages            // error pages, defaults to those of the hub
+	Spool    *SpoolConfig           // spooling of bodies, defaults to that of the hub
+}
+
+// HubConfig is the optional JSON config file of the hub (-config), e.g.
+//
+//	{
+//	  "TrustedProxies": ["10.0.0.0/8"],
+//	  "Rates": {"Client": {"PerSec": 5, "Burst": 20}},
+//	  "GeoIP": "GeoLite2-Country.mmdb",
+//	  "Access": {"Deny": ["192.0.2.0/24"]},
+//	  "Errors": {"Dir": "/etc/webx/errors"},
+//	  "Tunnels": {"ssh": ":2222"},
+//	  "Hosts": {
+//	    "www.example.com:8080": {"Rates": {"Host": {"PerSec": 100, "Burst": 200}}},
+//	    "partner.example.com": {"Access": {"Allow": ["198.51.100.0/24"], "AllowCountries": ["NZ"]}},
+//	    "wiki.example.com": {"Auth": {"Htpasswd": "/etc/webx/wiki.htpasswd"}},
+//	    "docs.example.com": {"Cache": {"MemBytes": 67108864, "StaleSecs": 3600}, "Coalesce": true,
+//	      "Compress": {"Brotli": true},
+//	      "Headers": {"Security": true, "Response": [{"Op": "remove", "Name": "Server"}]}},
+//	    "files.example.com": {"Spool": {"Requests": true, "Responses": true, "MaxBytes": 1073741824,
+//	      "TotalBytes": 8589934592, "Dir": "/var/spool/webx"}}
+//	  }
+//	}
+type HubConfig struct {
+	// CIDRs or IPs of proxies in front of the hub, whose Forwarded and
+	// X-Forwarded-* headers, and PROXY protocol headers with -proxy_protocol,
+	// are trusted to find real client addresses
+	TrustedProxies []string
+	// default request rate limits
+	Rates RateLimits
+	// GeoIP country database file for country access rules
+	GeoIP string
+	// access rules for all vhosts, checked before those of each vhost
+	Access *AccessRules
+	// default error pages of all vhosts
+	Errors *ErrorPages
+	// default spooling of bodies of all vhosts, disabled if nil
+	Spool *SpoolConfig
+	// secret shared with plugs to sign identities of authenticated
+	// visitors, no identity is passed if empty
+	IdentityKey string
+	// secret of requests to the admin API (see -admin), given as
+	// "Authorization: Bearer <AdminToken>", they are refused if empty
+	AdminToken string
+	// vhost -> settings
+	Hosts map[string]*HostConfig
+	// service name -> address of the TCP listener tunneling visitors to
+	// plugs registered for the name, e.g. {"ssh": ":2222"}. Settings of
+	// the name in Hosts, like Access and Rates, apply to new connections.
+	Tunnels map[string]string
+
+	trusted []*net.IPNet // parsed TrustedProxies
+}
+
+// the hub config, empty unless -config is given
+var config = &HubConfig{}
+
+// load hub config from JSON file
+func LoadConfig(file string) (*HubConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &HubConfig{}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.trusted, err = parse_cidrs(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.Access != nil {
+		if err = cfg.Access.parse(); err != nil {
+			return nil, err
+		}
+		// without the database every visitor would be denied
+		if cfg.Access.by_country() && cfg.GeoIP == "" {
+			return nil, errors.New("country rules need GeoIP")
+		}
+	}
+	if cfg.Errors != nil {
+		if err = cfg.Errors.load(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Spool != nil {
+		if err = cfg.Spool.check(); err != nil {
+			return nil, err
+		}
+	}
+	tunnels := make(map[string]string, len(cfg.Tunnels))
+	for name, addr := range cfg.Tunnels {
+		if name == "" || addr == "" {
+			return nil, errors.New("tunnel needs name and address")
+		}
+		tunnels[strings.ToLower(name)] = addr
+	}
+	cfg.Tunnels = tunnels
+	hosts := make(map[string]*HostConfig, len(cfg.Hosts))
+	for vhost, hc := range cfg.Hosts {
+		if hc == nil {
+			continue
+		}
+		hosts[strings.ToLower(vhost)] = hc
+		if hc.Access != nil {
+			if err = hc.Access.parse(); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+			if hc.Access.by_country() && cfg.GeoIP == "" {
+				return nil, errors.New(vhost + ": country rules need GeoIP")
+			}
+		}
+		if a := hc.Auth; a != nil {
+			if a.Htpasswd == "" && a.OIDC == nil {
+				return nil, errors.New(vhost + ": auth needs Htpasswd or OIDC")
+			}
+			if a.OIDC != nil && (a.OIDC.Issuer == "" || a.OIDC.ClientID == "") {
+				return nil, errors.New(vhost + ": OIDC needs Issuer and ClientID")
+			}
+		}
+		if hc.Errors != nil {
+			if err = hc.Errors.load(); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+		}
+		if hc.Spool != nil {
+			if err = hc.Spool.check(); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+		}
+		if hc.Headers != nil {
+			if err = hc.Headers.Compile(); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+		}
+		if hc.Cache != nil {
+			if hc.Cache.store, err = NewCacheStore(hc.Cache); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+		}
+	}
+	cfg.Hosts = hosts
+	if cfg.GeoIP != "" {
+		if err = OpenGeoIP(cfg.GeoIP); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// settings of the vhost, nil if not configured. Settings of a host name
+// without port apply to the vhosts of that name on any port.
+func (cfg *HubConfig) host(vhost string) *HostConfig {
+	vhost = strings.ToLower(vhost)
+	if hc, ok := cfg.Hosts[vhost]; ok {
+		return hc
+	}
+	return cfg.Hosts[host_name(vhost)]
+}
+
+// rate limits of the vhost
+func (cfg *HubConfig) rates(vhost string) *RateLimits {
+	if hc := cfg.host(vhost); hc != nil && hc.Rates != nil {
+		return hc.Rates
+	}
+	return &cfg.Rates
+}
+
+// parse list of CIDRs, plain IPs are taken as single address nets
+func parse_cidrs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("bad IP: " + s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// check whether the ip is inside any of the nets
+func in_nets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,17 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package main
+package webx_hub
 
 import (
 	"bufio"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"github.com/yf13/webswitch"
 )
 
@@ -30,9 +32,13 @@ type PlugConn struct {
 	birth int64
 	// uses count
 	uses uint64
+	// whether messages are streamed, see webswitch.StreamWriter
+	stream bool
+	// whether the plug gets no more requests, see CMD_PLUG_DRAIN
+	draining bool
 }
 
-// outgoing request queue length
+// default outgoing request queue length, see -plug_queue
 const OUT_BUFFER_LENGTH = 5
 
 // connection.Reader reads incoming websocket text messages
@@ -45,18 +51,25 @@ func (c *PlugConn) Reader(h *Hub) {
 	}()
 
 	closeCh := make(chan bool, 1)
-	pres := &PlugResponse{nil, closeCh}
 
 	for {
 		// read message from web socket
-		mt, r, err := c.ws.NextReader()
-		if err != nil {
-			log.Printf("error read plug: %v\n", err)
-			break
-		}
-		if mt != websocket.BinaryMessage {
-			// TODO: other types also possible here?
-			log.Printf("error plug resp type: %v", mt)
+		var r io.Reader
+		var sr *webswitch.StreamReader
+		if c.stream {
+			sr = webswitch.NewStreamReader(c.ws)
+			r = sr
+		} else {
+			mt, mr, err := c.ws.NextReader()
+			if err != nil {
+				log.Printf("error read plug: %v\n", err)
+				break
+			}
+			if mt != websocket.BinaryMessage {
+				// TODO: other types also possible here?
+				log.Printf("error plug resp type: %v", mt)
+			}
+			r = mr
 		}
 		rsp, err := http.ReadResponse(bufio.NewReader(r), nil)
 		if err == nil {
@@ -64,11 +77,17 @@ func (c *PlugConn) Reader(h *Hub) {
 			// the rsp.Body finally.
 			log.Printf("rcvd plug rsp#%s clen=%d", webswitch.ResponseId(rsp),
 				rsp.ContentLength)
-			pres.Resp = rsp
-			h.rsp_queue <- pres
+			// a response of its own, it may outlive the wait when spooled
+			h.rsp_queue <- &PlugResponse{rsp, closeCh}
 			// wait until the rsp has been closed
 			_ = <-closeCh
-
+			// skip what the client left in the stream
+			if sr != nil {
+				if err = sr.Drain(); err != nil {
+					log.Printf("error drain plug: %v", err)
+					break
+				}
+			}
 		} else {
 			log.Printf("error read plug resp: %v", err)
 			break
@@ -86,15 +105,34 @@ func (c *PlugConn) Writer() {
 
 	for {
 		if req, ok := <-c.obuf; ok {
+			// skip compressing bodies that are compressed already
+			c.ws.EnableWriteCompression(webswitch.Compressible(req.Header))
+			// the request is cut short if its body is beyond the limit, the
+			// visitor gets 413 and the plug an incomplete body
+			lb, _ := req.Body.(*limitBody)
+			if c.stream {
+				// stream the request, its body is sent as it arrives
+				if err := webswitch.StreamRequest(c.ws, req); err != nil && lb != nil && lb.exceeded() {
+					log.Printf("cut req#%s to plug: %v", webswitch.RequestId(req), err)
+					continue
+				} else if err != nil {
+					log.Println("error stream plug:", err)
+					return
+				}
+				log.Printf("sent req#%s to plug\n", webswitch.RequestId(req))
+				continue
+			}
 			// forward the request to websocket
 			w, err := c.ws.NextWriter(websocket.BinaryMessage)
 			if err != nil {
-				log.Println("error open plug writer: %v", err)
+				log.Println("error open plug writer:", err)
 				return
 			}
 			// Request.Write/WriteProxy will close the req.Body
-			if err := req.WriteProxy(w); err != nil {
-				log.Println("error write plug: %v", err)
+			if err := req.WriteProxy(w); err != nil && lb != nil && lb.exceeded() {
+				log.Printf("cut req#%s to plug: %v", webswitch.RequestId(req), err)
+			} else if err != nil {
+				log.Println("error write plug:", err)
 				return
 			}
 			w.Close()
@@ -138,8 +176,14 @@ func handlePlug(w http.ResponseWriter, r *http.Request) {
 
 	// check if it is a plug request
 	if hosts := r.Header[webswitch.HEADER_PROXY_FOR]; len(hosts) > 0 {
+		// accept streaming if the plug asks for it
+		stream := r.Header.Get(webswitch.HEADER_STREAM) != ""
+		var rh http.Header
+		if stream {
+			rh = http.Header{webswitch.HEADER_STREAM: {"1"}}
+		}
 		// Update registry accordingly
-		ws, err := upgrader.Upgrade(w, r, nil)
+		ws, err := upgrader.Upgrade(w, r, rh)
 		if err != nil {
 			log.Println("error upgrade:", err)
 			// need respond to backend
@@ -153,17 +197,20 @@ func handlePlug(w http.ResponseWriter, r *http.Request) {
 			l = n
 		}
 		c := &PlugConn{
-			hosts,
-			make(chan *http.Request, OUT_BUFFER_LENGTH),
-			ws,
-			l, 0, 0, 0,
+			hosts:  hosts,
+			obuf:   make(chan *http.Request, *plug_queue),
+			ws:     ws,
+			limit:  l,
+			stream: stream,
 		}
 		n := hub.register(c)
 		// start writer loop
 		go c.Writer()
 		// run reader loop w/ the singleton hub
 		go c.Reader(hub)
-		log.Println(n, "hosts registered, total is", hub.hosts_count(nil))
+		log.Println(n, "hosts registered, total is", hub.hosts_count(nil),
+			"deflate offered:", upgrader.EnableCompression &&
+				strings.Contains(r.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"))
 	} else {
 		// TODO: implement status dump based on switch hub status later
 		fmt.Fprintln(w, hub.status_query(false))
@@ -4,7 +4,7 @@
 
 /*
 
-This is the web switch frontend hub.
+This is the web switch frontend hub, run by the "webx hub" command.
 
 The hub accepts secure connections from plugs as well as standard
 web (http/https) connections from visitors. It then forwards visitor'
@@ -21,18 +21,67 @@ The hub maintains a central registry of plugs organized by host names and
 message limits. This way, message of different sizes will be passed to
 different plugs so that big messages don't block small ones. Multiple plugs
 with different limit can exist for one host, and one plug can support
-multiple hosts.
+multiple hosts. Bodies of unknown length, like chunked uploads, are read
+ahead up to 64KB to learn their size; larger ones go to unlimited plugs, or
+else to those of the largest limit, and visitors get 413 when a body goes
+beyond the limit of its plug. With "Spool" in the config, bodies are read
+ahead into memory and temp files, so slow visitors don't hold plug links.
+Plug queues are bounded and requests go to the next plug when one is full;
+visitors get 503 with Retry-After when all plugs of a host are saturated.
 
 The hub should provide web query access for latest status of its central
 registry.
 
+With -admin and an AdminToken, an admin API on its own listener operates the
+running hub: it lists and disconnects plugs, puts vhosts in maintenance with
+503 answers, changes rate limits, drops pending requests and purges caches.
+
+Optional settings, global or per vhost, come from a JSON config file. Token
+bucket rate limits per vhost, per client IP and per plug are applied before
+requests reach plugs, and limited requests get 429 with Retry-After.
+Client IPs are checked against allow/deny rules by CIDR or by country with a
+local GeoIP database, and denied clients get 403. Vhosts can require
+visitors to authenticate with Basic auth against an htpasswd file or to log
+in through OpenID Connect, and unauthenticated requests never reach plugs.
+Vhosts can also cache responses in memory and disk tiers, revalidate them
+with plugs, and serve them stale when plugs are gone or failing. Identical
+concurrent GETs can be coalesced, so only one reaches the plug. Responses
+can be compressed with gzip or brotli as visitors accept.
+
+Messages on plug links are compressed by per-message deflate when both ends
+agree, except bodies that are compressed already.
+
 Then for each web client request, there is 1 routine created and exist
 until the request is done.
 
-The hub needs have proper subjectAlternativeNames fields in its cerficate
-so that web clients can make HTTPS connections successfully. This nomrally
-means all hub hostnames known to  visitors and plugs should be listed in hub's
-certificate.
+TCP services are published through tunnels. The hub listens on a port for
+each name in Tunnels of the config, and for each connection asks a plug of
+the name with a CONNECT request to dial the real host and connect back a
+websocket carrying the bytes. On -tls_passthrough ports, the hub takes the
+SNI name of each ClientHello as the name and passes the TLS stream through
+unterminated, so only the real host holds the certificate.
+
+Real hosts learn about visitors from Forwarded and X-Forwarded-* headers.
+Those from proxies listed as trusted are extended, others are dropped. With
+-proxy_protocol, trusted proxies like TCP load balancers can pass client
+addresses in PROXY protocol v1/v2 headers.
+
+Visitors can use HTTP/2 over TLS, or h2c on http ports. Plugs dialing with
+the X-Webx-Stream header get messages streamed across the link, so bodies
+flow as they arrive and trailers are kept, as gRPC needs.
+
+The hub selects its certificate by SNI for each TLS handshake. Besides the
+default -cert/-key pair, a -certs directory can hold one pair per published
+site as "name.crt" and "name.key", optionally with a locally cached DER
+encoded OCSP response "name.ocsp" to staple. Changed files are reloaded
+periodically without restart. Names matching no certificate get the default
+pair, or the first pair of the directory when no default is given.
+
+With -acme_hosts, the hub also obtains and renews certificates through ACME
+for published hosts, i.e. names matching the allowlist and having registered
+plugs. Both HTTP-01 (on http ports) and TLS-ALPN-01 (on https ports)
+challenges are answered, and the ACME account and certificates are cached in
+the -acme_cache directory. Certificates from -cert/-certs take precedence.
 
 */
-package main
+package webx_hub
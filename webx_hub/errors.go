@@ -0,0 +1,201 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorPages renders bodies of error responses to visitors from template
+// files in Dir, named by status code or class and by type, e.g. "404.html",
+// "5xx.json" or "error.html", tried in that order. HTML templates are
+// used unless the visitor prefers JSON. Templates get an ErrorInfo.
+type ErrorPages struct {
+	Dir string
+
+	html *htmltemplate.Template
+	json *texttemplate.Template
+}
+
+// content types of error pages by template extension
+var ERROR_PAGE_TYPES = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".json": "application/json",
+}
+
+// ErrorInfo is the data of error page templates
+type ErrorInfo struct {
+	Status     int    // status code
+	StatusText string // status text, e.g. "Not Found"
+	RequestId  string // request id of the hub, empty if none assigned
+	Host       string // vhost of the request
+	Path       string // path of the request
+}
+
+// load the templates
+func (ep *ErrorPages) load() error {
+	files, err := ioutil.ReadDir(ep.Dir)
+	if err != nil {
+		return err
+	}
+	ep.html = htmltemplate.New("")
+	ep.json = texttemplate.New("").Funcs(texttemplate.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	})
+	count := 0
+	for _, f := range files {
+		name := f.Name()
+		data, err := ioutil.ReadFile(filepath.Join(ep.Dir, name))
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(name) {
+		case ".html":
+			_, err = ep.html.New(name).Parse(string(data))
+		case ".json":
+			_, err = ep.json.New(name).Parse(string(data))
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		count += 1
+	}
+	if count == 0 {
+		return errors.New("no error templates in " + ep.Dir)
+	}
+	return nil
+}
+
+// names of templates for the code, most specific first
+func error_templates(code int, ext string) []string {
+	return []string{strconv.Itoa(code) + ext,
+		strconv.Itoa(code/100) + "xx" + ext, "error" + ext}
+}
+
+// render the page for the status code, returns the content type and body
+// or false if no template applies
+func (ep *ErrorPages) render(code int, prefer_json bool, info *ErrorInfo) (string, []byte, bool) {
+	exts := []string{".html", ".json"}
+	if prefer_json {
+		exts[0], exts[1] = exts[1], exts[0]
+	}
+	for _, ext := range exts {
+		for _, name := range error_templates(code, ext) {
+			var buf bytes.Buffer
+			var err error
+			switch {
+			case ext == ".html" && ep.html.Lookup(name) != nil:
+				err = ep.html.ExecuteTemplate(&buf, name, info)
+			case ext == ".json" && ep.json.Lookup(name) != nil:
+				err = ep.json.ExecuteTemplate(&buf, name, info)
+			default:
+				continue
+			}
+			if err == nil {
+				return ERROR_PAGE_TYPES[ext], buf.Bytes(), true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// whether the Accept header prefers JSON to HTML
+func prefers_json(accept string) bool {
+	jq, hq := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		switch {
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			if q > jq {
+				jq = q
+			}
+		case mt == "text/html" || mt == "application/xhtml+xml":
+			if q > hq {
+				hq = q
+			}
+		}
+	}
+	return jq > hq
+}
+
+// error pages of the vhost
+func (cfg *HubConfig) error_pages(vhost string) *ErrorPages {
+	if hc := cfg.host(vhost); hc != nil && hc.Errors != nil {
+		return hc.Errors
+	}
+	return cfg.Errors
+}
+
+// errorPage answers errors of one visitor request
+type errorPage struct {
+	pages       *ErrorPages // nil if none configured
+	prefer_json bool
+	info        ErrorInfo
+}
+
+// the error page of a visitor request
+func error_page(r *http.Request) *errorPage {
+	return &errorPage{
+		pages:       config.error_pages(r.Host),
+		prefer_json: prefers_json(r.Header.Get("Accept")),
+		info:        ErrorInfo{Host: r.Host, Path: r.URL.Path},
+	}
+}
+
+// answer the error with the page if there is a template for it, headers
+// already set are kept. returns false if nothing is written.
+func (ep *errorPage) write(w http.ResponseWriter, code int, reqId string) bool {
+	if ep.pages == nil {
+		return false
+	}
+	info := ep.info
+	info.Status, info.StatusText, info.RequestId = code, http.StatusText(code), reqId
+	ct, body, ok := ep.pages.render(code, ep.prefer_json, &info)
+	if !ok {
+		return false
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", ct)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+	return true
+}
+
+// answer the error with the page, or a plain text one
+func (ep *errorPage) send(w http.ResponseWriter, code int, reqId string) {
+	if !ep.write(w, code, reqId) {
+		http.Error(w, http.StatusText(code), code)
+	}
+}
+
+// whether the response has no body, like errors made by hubs and plugs
+func bodyless(rsp *http.Response) bool {
+	return rsp.Body == nil || rsp.Body == http.NoBody || rsp.ContentLength == 0
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_error_pages(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "404.html"),
+		[]byte(`<h1>{{.Host}}{{.Path}} not found</h1><p>ref {{.RequestId}}</p>`), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "5xx.json"),
+		[]byte(`{"error": {{json .StatusText}}, "id": {{json .RequestId}}}`), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "403.html"), []byte(`denied, ref {{.RequestId}}`), 0600)
+	pages := &ErrorPages{Dir: dir}
+	if err := pages.load(); err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Hosts: map[string]*HostConfig{"www.test": {Errors: pages}}}
+
+	for _, c := range []struct {
+		code   int
+		accept string
+		ctype  string
+		body   string
+	}{
+		{404, "text/html,*/*", "text/html; charset=utf-8",
+			`<h1>www.test/a&lt;b not found</h1><p>ref 7</p>`},
+		// only the JSON template fits 502
+		{502, "text/html", "application/json",
+			`{"error": "Bad Gateway", "id": "7"}`},
+		{413, "", "text/plain; charset=utf-8", "Request Entity Too Large\n"},
+	} {
+		r := httptest.NewRequest("GET", "http://www.test/a<b", nil)
+		r.Header.Set("Accept", c.accept)
+		w := httptest.NewRecorder()
+		error_page(r).send(w, c.code, "7")
+		if w.Code != c.code || w.Header().Get("Content-Type") != c.ctype || w.Body.String() != c.body {
+			t.Errorf("%d: got %d %s %q", c.code, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+	}
+
+	// early denials carry the request id too
+	deny := &AccessRules{Deny: []string{"0.0.0.0/0"}}
+	if err := deny.parse(); err != nil {
+		t.Fatal(err)
+	}
+	config.Hosts["www.test"].Access = deny
+	w := httptest.NewRecorder()
+	handleClient(w, httptest.NewRequest("GET", "http://www.test/", nil))
+	if body := w.Body.String(); w.Code != 403 || !strings.HasPrefix(body, "denied, ref ") ||
+		body == "denied, ref " {
+		t.Errorf("expected denial with id, got %d %q", w.Code, body)
+	}
+
+	for accept, json := range map[string]bool{
+		"application/json":                 true,
+		"text/html,application/json;q=0.9": false,
+		"application/problem+json, */*":    true,
+		"":                                 false,
+	} {
+		if prefers_json(accept) != json {
+			t.Errorf("%q: expected %v", accept, json)
+		}
+	}
+}
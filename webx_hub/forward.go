@@ -0,0 +1,247 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/yf13/webswitch"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headers telling real hosts about visitors, dropped if not set by the
+// hub or trusted proxies
+var FORWARD_HEADERS = []string{webswitch.HEADER_FORWARDED, webswitch.HEADER_FORWARD_FOR,
+	webswitch.HEADER_FORWARD_PROTO, webswitch.HEADER_FORWARD_HOST}
+
+// IP of the address, nil if not an IP
+func addr_ip(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// set the Forwarded and X-Forwarded-* headers of a visitor request. Those
+// from trusted proxies are extended, others are dropped as spoofed.
+func forward_headers(r *http.Request) {
+	h := r.Header
+	peer := r.RemoteAddr
+	ip := addr_ip(peer)
+	if ip != nil {
+		peer = ip.String()
+	}
+	if ip == nil || !in_nets(ip, config.trusted) {
+		for _, k := range FORWARD_HEADERS {
+			h.Del(k)
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if h.Get(webswitch.HEADER_FORWARD_PROTO) == "" {
+		h.Set(webswitch.HEADER_FORWARD_PROTO, proto)
+	}
+	if h.Get(webswitch.HEADER_FORWARD_HOST) == "" {
+		h.Set(webswitch.HEADER_FORWARD_HOST, r.Host)
+	}
+	if xff := h.Get(webswitch.HEADER_FORWARD_FOR); xff != "" {
+		h.Set(webswitch.HEADER_FORWARD_FOR,
+			strings.Join(h[webswitch.HEADER_FORWARD_FOR], ", ")+", "+peer)
+	} else {
+		h.Set(webswitch.HEADER_FORWARD_FOR, peer)
+	}
+	node := peer
+	if ip != nil && ip.To4() == nil {
+		node = "[" + peer + "]"
+	}
+	h.Add(webswitch.HEADER_FORWARDED, "for="+forwarded_value(node)+
+		";host="+forwarded_value(r.Host)+";proto="+proto)
+}
+
+// quote the value of a Forwarded pair unless it is a token
+func forwarded_value(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// addresses of visitors and proxies the request went through, nearest
+// last. The longer chain of Forwarded and X-Forwarded-For is taken, as
+// proxies may set either. Ports are dropped, and unknown or obfuscated
+// nodes are kept as they are.
+func forwarded_for(h http.Header) []string {
+	var fwd []string
+	if len(h[webswitch.HEADER_FORWARDED]) > 0 {
+		for _, elem := range strings.Split(strings.Join(h[webswitch.HEADER_FORWARDED], ","), ",") {
+			node := ""
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					node = strings.Trim(kv[1], `"`)
+				}
+			}
+			fwd = append(fwd, node)
+		}
+	}
+	var xff []string
+	if len(h[webswitch.HEADER_FORWARD_FOR]) > 0 {
+		xff = strings.Split(strings.Join(h[webswitch.HEADER_FORWARD_FOR], ","), ",")
+	}
+	nodes := fwd
+	if len(xff) > len(fwd) {
+		nodes = xff
+	}
+	for i, n := range nodes {
+		n = strings.TrimSpace(n)
+		if ip := addr_ip(n); ip != nil {
+			n = ip.String()
+		} else if ip = net.ParseIP(strings.Trim(n, "[]")); ip != nil {
+			n = ip.String()
+		}
+		nodes[i] = n
+	}
+	return nodes
+}
+
+// PROXY protocol settings
+const (
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
+	PROXY_V1_MAX         = 107 // longest v1 header line
+	PROXY_V2_MAX         = 4096
+)
+
+// signature of PROXY protocol v2 headers
+var PROXY_V2_SIG = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// read the PROXY protocol v1 or v2 header if any, returns the source
+// address it carries, nil for a missing header or one without address
+func read_proxy_header(br *bufio.Reader) (net.Addr, error) {
+	if b, err := br.Peek(6); err == nil && string(b) == "PROXY " {
+		line, err := br.ReadSlice('\n')
+		if err != nil || len(line) > PROXY_V1_MAX || !bytes.HasSuffix(line, []byte("\r\n")) {
+			return nil, errors.New("bad PROXY v1 header")
+		}
+		f := strings.Fields(string(line))
+		if len(f) >= 2 && f[1] == "UNKNOWN" {
+			return nil, nil
+		}
+		if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+			return nil, errors.New("bad PROXY v1 header")
+		}
+		ip := net.ParseIP(f[2])
+		port, err := strconv.ParseUint(f[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, errors.New("bad PROXY v1 address")
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+	if b, err := br.Peek(len(PROXY_V2_SIG)); err != nil || !bytes.Equal(b, PROXY_V2_SIG) {
+		return nil, nil
+	}
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[14:]))
+	if hdr[12]>>4 != 2 || size > PROXY_V2_MAX {
+		return nil, errors.New("bad PROXY v2 header")
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	// LOCAL command, e.g. health checks of the proxy itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if size >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[:4]),
+				Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+		}
+	case 0x21: // TCP over IPv6
+		if size >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[:16]),
+				Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+		}
+	default:
+		return nil, nil
+	}
+	return nil, errors.New("short PROXY v2 address")
+}
+
+// proxyListener accepts PROXY protocol headers from trusted proxies, so
+// that visitor requests get the addresses of real clients
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	if ip := addr_ip(c.RemoteAddr().String()); ip == nil || !in_nets(ip, config.trusted) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the PROXY protocol header on first use, not to block
+// the accepting routine
+type proxyConn struct {
+	net.Conn
+	br     *bufio.Reader
+	once   sync.Once
+	remote net.Addr // source address in the header, nil if none
+	err    error
+}
+
+// read the header once
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		c.remote, c.err = read_proxy_header(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Println("error proxy header from", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// half-close the underlying conn if it can, as tunnels need
+func (c *proxyConn) CloseWrite() error {
+	return close_write(c.Conn)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
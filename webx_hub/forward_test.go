@@ -0,0 +1,152 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_forward_headers(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{}
+	config.trusted, _ = parse_cidrs([]string{"10.0.0.0/8"})
+
+	// spoofed headers of untrusted peers are dropped
+	r := &http.Request{RemoteAddr: "[2001:db8::1]:5678", Host: "www.test:8080", Header: http.Header{
+		"X-Forwarded-For":   {"6.6.6.6"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=6.6.6.6"},
+	}, TLS: &tls.ConnectionState{}}
+	forward_headers(r)
+	for k, v := range map[string]string{
+		"X-Forwarded-For":   "2001:db8::1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "www.test:8080",
+		"Forwarded":         `for="[2001:db8::1]";host="www.test:8080";proto=https`,
+	} {
+		if got := strings.Join(r.Header[k], "|"); got != v {
+			t.Errorf("%s: expected %s got %s", k, v, got)
+		}
+	}
+
+	// those of trusted proxies are extended
+	r = &http.Request{RemoteAddr: "10.1.1.1:80", Host: "www.test", Header: http.Header{
+		"X-Forwarded-For":   {"7.7.7.7"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"www.test"},
+		"Forwarded":         {`for=7.7.7.7;proto=https`},
+	}}
+	forward_headers(r)
+	for k, v := range map[string]string{
+		"X-Forwarded-For":   "7.7.7.7, 10.1.1.1",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         "for=7.7.7.7;proto=https|for=10.1.1.1;host=www.test;proto=http",
+	} {
+		if got := strings.Join(r.Header[k], "|"); got != v {
+			t.Errorf("%s: expected %s got %s", k, v, got)
+		}
+	}
+	if ip := client_ip(r); ip != "7.7.7.7" {
+		t.Error("expected 7.7.7.7, got", ip)
+	}
+
+	// X-Forwarded-For of trusted proxies without Forwarded
+	r = &http.Request{RemoteAddr: "10.1.1.1:80", Host: "www.test",
+		Header: http.Header{"X-Forwarded-For": {"7.7.7.7, 10.2.2.2"}}}
+	forward_headers(r)
+	if ip := client_ip(r); ip != "7.7.7.7" {
+		t.Error("expected 7.7.7.7, got", ip)
+	}
+
+	// the longer chain is taken and its nodes are cleaned
+	h := http.Header{"Forwarded": {`for="[2001:db8::2]:80", for=unknown;proto=http`},
+		"X-Forwarded-For": {"1.1.1.1"}}
+	if nodes := forwarded_for(h); len(nodes) != 2 || nodes[0] != "2001:db8::2" || nodes[1] != "unknown" {
+		t.Error("unexpected nodes", nodes)
+	}
+}
+
+// a PROXY v2 header of a TCP over IPv4 source
+func proxy_v2(cmd byte, src net.IP, port uint16) string {
+	b := append([]byte{}, PROXY_V2_SIG...)
+	b = append(b, 0x20|cmd, 0x11, 0, 12)
+	b = append(b, src.To4()...)
+	b = append(b, 10, 0, 0, 1)
+	b = binary.BigEndian.AppendUint16(b, port)
+	b = binary.BigEndian.AppendUint16(b, 443)
+	return string(b)
+}
+
+func Test_proxy_header(t *testing.T) {
+	for _, c := range []struct {
+		in, addr string
+		bad      bool
+	}{
+		{"PROXY TCP4 192.0.2.1 10.0.0.1 5678 80\r\nGET / HTTP/1.1\r\n", "192.0.2.1:5678", false},
+		{"PROXY TCP6 2001:db8::1 ::1 5678 80\r\nGET /", "[2001:db8::1]:5678", false},
+		{"PROXY UNKNOWN\r\nGET /", "", false},
+		{"POST / HTTP/1.1\r\n", "", false},
+		{proxy_v2(1, net.ParseIP("192.0.2.9"), 4000) + "GET /", "192.0.2.9:4000", false},
+		{proxy_v2(0, net.ParseIP("192.0.2.9"), 4000) + "GET /", "", false},
+		{"PROXY TCP4 bogus\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 10.0.0.1 5678 80\n", "", true},
+	} {
+		br := bufio.NewReader(strings.NewReader(c.in))
+		addr, err := read_proxy_header(br)
+		if (err != nil) != c.bad {
+			t.Errorf("%q: unexpected error %v", c.in, err)
+			continue
+		}
+		if got := ""; addr != nil {
+			got = addr.String()
+			if got != c.addr {
+				t.Errorf("%q: expected %s got %s", c.in, c.addr, got)
+			}
+		} else if c.addr != "" {
+			t.Errorf("%q: expected %s got nil", c.in, c.addr)
+		}
+		if !c.bad {
+			if rest, _ := br.Peek(4); string(rest) != "GET " && string(rest) != "POST" {
+				t.Errorf("%q: header not consumed, left %q", c.in, rest)
+			}
+		}
+	}
+
+	// the listener takes the client address from trusted proxies
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{}
+	config.trusted, _ = parse_cidrs([]string{"127.0.0.1"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 5678 80\r\nhello"))
+			c.Close()
+		}
+	}()
+	c, err := (&proxyListener{l}).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 5)
+	if addr := c.RemoteAddr().String(); addr != "192.0.2.1:5678" {
+		t.Error("expected 192.0.2.1:5678, got", addr)
+	}
+	if n, _ := c.Read(buf); string(buf[:n]) != "hello" {
+		t.Error("expected hello, got", string(buf[:n]))
+	}
+}
@@ -2,38 +2,66 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package main
+package webx_hub
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 	"github.com/yf13/webswitch"
 )
 
 // enum of hub command codes
 const (
-	CMD_HOST_CNT  = 0
-	CMD_PLUG_IN   = 1
-	CMD_PLUG_OUT  = 2
-	CMD_PLUG_DUMP = 3
+	CMD_HOST_CNT   = 0
+	CMD_PLUG_IN    = 1
+	CMD_PLUG_OUT   = 2
+	CMD_PLUG_DUMP  = 3
+	CMD_NAME_CNT   = 4
+	CMD_PLUG_KICK  = 5
+	CMD_PLUG_LIST  = 6
+	CMD_HOST_OFF   = 7
+	CMD_HOST_ON    = 8
+	CMD_SET_RATES  = 9
+	CMD_REQ_PURGE  = 10
+	CMD_PLUG_DRAIN = 11
 )
 
 // base of numeric request id
 const REQ_ID_BASE = 10
 
+// the last request id given out
+var last_req_id uint64
+
+// give out a new request id, so visitors get it even with early denials
+func next_req_id() string {
+	return strconv.FormatUint(atomic.AddUint64(&last_req_id, 1), REQ_ID_BASE)
+}
+
+// default cap of requests waiting for plug replies, see -max_pending
+const MAX_PENDING = 10000
+
+// retry hint to visitors when plugs are saturated
+const BUSY_RETRY = time.Second
+
 // hub management command
 // TODO: review if "string" is best carrier for replies.
 type HubCommand struct {
 	cmd      uint8         // the command code as above CMD_* constants
 	conn     *PlugConn     // the plug conn to add/drop
 	reply_ch chan<- string // the chan to accept command response
+	args     []string      // arguments like plug id or vhost
 }
 
 // client Request contains original client request and a reply-to chan
 type ClientRequest struct {
 	req      *http.Request        // original plus x-forwared-for
 	reply_ch chan<- *PlugResponse // chan to accept response
+	user     string               // authenticated visitor, empty if none
 }
 
 // Hub exchanges messages between clients and plugs
@@ -51,6 +79,8 @@ type Hub struct {
 	pending_reqs map[uint64]chan<- *PlugResponse
 	// the request id since start of the hub
 	req_id uint64
+	// vhosts in maintenance -> seconds for Retry-After, may be empty
+	disabled map[string]string
 }
 
 // the signleton switch hub
@@ -60,7 +90,7 @@ var hub = &Hub{}
 // returns the number registries added
 func (h *Hub) register(plug *PlugConn) int {
 	reply_ch := make(chan string, 1)
-	cmd := &HubCommand{CMD_PLUG_IN, plug, reply_ch}
+	cmd := &HubCommand{CMD_PLUG_IN, plug, reply_ch, nil}
 	h.cmd_queue <- cmd
 	reply, _ := <-reply_ch
 	count, _ := strconv.ParseInt(reply, 10, 32)
@@ -71,7 +101,7 @@ func (h *Hub) register(plug *PlugConn) int {
 // returns number of dropped entries
 func (h *Hub) unregister(plug *PlugConn) int {
 	reply_ch := make(chan string, 1)
-	cmd := &HubCommand{CMD_PLUG_OUT, plug, reply_ch}
+	cmd := &HubCommand{CMD_PLUG_OUT, plug, reply_ch, nil}
 	h.cmd_queue <- cmd
 	reply, _ := <-reply_ch
 	count, _ := strconv.ParseInt(reply, 10, 32)
@@ -83,8 +113,19 @@ func (h *Hub) unregister(plug *PlugConn) int {
 // empty input lists will get number of total registered hosts
 func (h *Hub) hosts_count(hosts []string) int {
 	reply_ch := make(chan string, 1)
-	plug := &PlugConn{hosts, nil, nil, 0, 0, 0, 0}
-	cmd := &HubCommand{CMD_HOST_CNT, plug, reply_ch}
+	plug := &PlugConn{hosts: hosts}
+	cmd := &HubCommand{CMD_HOST_CNT, plug, reply_ch, nil}
+	h.cmd_queue <- cmd
+	reply, _ := <-reply_ch
+	count, _ := strconv.ParseInt(reply, 10, 32)
+	return int(count)
+}
+
+// query number of given host names having registered vhosts on any port
+func (h *Hub) names_count(names []string) int {
+	reply_ch := make(chan string, 1)
+	plug := &PlugConn{hosts: names}
+	cmd := &HubCommand{CMD_NAME_CNT, plug, reply_ch, nil}
 	h.cmd_queue <- cmd
 	reply, _ := <-reply_ch
 	count, _ := strconv.ParseInt(reply, 10, 32)
@@ -94,12 +135,50 @@ func (h *Hub) hosts_count(hosts []string) int {
 // query registry status
 func (h *Hub) status_query(ident bool) string {
 	reply_ch := make(chan string, 1)
-	cmd := &HubCommand{CMD_PLUG_DUMP, nil, reply_ch}
+	cmd := &HubCommand{CMD_PLUG_DUMP, nil, reply_ch, nil}
 	h.cmd_queue <- cmd
 	status, _ := <-reply_ch
 	return status
 }
 
+// run a command with the arguments, returns its reply
+func (h *Hub) command(cmd uint8, args ...string) string {
+	reply_ch := make(chan string, 1)
+	h.cmd_queue <- &HubCommand{cmd, nil, reply_ch, args}
+	reply, _ := <-reply_ch
+	return reply
+}
+
+// status of the hub for queries
+type HubStatus struct {
+	*PlugRegistry
+	Limits   map[string]float64 // available tokens of rate limit buckets
+	Disabled map[string]string  // vhosts in maintenance
+	Pending  int                // number of pending requests
+}
+
+// dump the hub status as JSON string
+// ident controls whether to ident the result
+func (h *Hub) status(ident bool) (string, error) {
+	st := &HubStatus{&h.plugs, limiter.state(), h.disabled, len(h.pending_reqs)}
+	var d []byte
+	var err error
+	if ident {
+		d, err = json.MarshalIndent(st, "", "  ")
+	} else {
+		d, err = json.Marshal(st)
+	}
+	return string(d), err
+}
+
+// deny a client request with 503 as no plug could queue it for now
+func (h *Hub) busy(cr *ClientRequest) {
+	rsp := webswitch.QuickResponse(http.StatusServiceUnavailable, cr.req)
+	rsp.Header.Set("Retry-After", retry_after(BUSY_RETRY))
+	cr.reply_ch <- &PlugResponse{rsp, nil}
+	close(cr.reply_ch)
+}
+
 // The switching and management logic of the hub
 //
 //	- for req, assign reqId, forward to plug conn and keep pending Ids;
@@ -115,6 +194,7 @@ func (h *Hub) run() {
 	h.rsp_queue = make(chan *PlugResponse, 10)
 	h.pending_reqs = make(map[uint64]chan<- *PlugResponse)
 	h.cmd_queue = make(chan *HubCommand, 1)
+	h.disabled = make(map[string]string)
 
 	// close all pending requests upon end of this switch routine
 	defer func() {
@@ -123,12 +203,6 @@ func (h *Hub) run() {
 		}
 	}()
 
-	// error for unknown hosts
-	errNotFound := &PlugResponse{
-		webswitch.QuickResponse(http.StatusNotFound, nil), nil}
-	errReqTooBig := &PlugResponse{
-		webswitch.QuickResponse(http.StatusRequestEntityTooLarge, nil), nil}
-
 	// The main switch loop
 	for {
 
@@ -136,25 +210,68 @@ func (h *Hub) run() {
 		// ==== incoming client request
 		case cr, ok := <-h.req_queue:
 			if ok {
-				h.req_id += 1
-				if _, ok = h.plugs.Hosts[cr.req.Host]; ok {
-					if pe := h.plugs.alloc(cr.req); pe != nil {
-						log.Println("found plug for", cr.req.Host)
-						s := strconv.FormatUint(h.req_id, REQ_ID_BASE)
-						cr.req.Header.Add(webswitch.HEADER_REQUEST_ID, s)
-						cr.req.Header.Add(webswitch.HEADER_FORWARD_FOR, cr.req.RemoteAddr)
-						pe.forward(cr.req)
-						log.Printf("fwrd req#%d to plug", h.req_id)
-						// keep request id with its reply_ch
-						h.pending_reqs[h.req_id] = cr.reply_ch
-					} else {
-						cr.reply_ch <- errReqTooBig
+				// client handlers give out ids, others get theirs here
+				s := webswitch.RequestId(cr.req)
+				id, err := strconv.ParseUint(s, REQ_ID_BASE, 64)
+				if err != nil {
+					s = next_req_id()
+					id, _ = strconv.ParseUint(s, REQ_ID_BASE, 64)
+				}
+				h.req_id = id
+				// the id also goes with errors, to correlate them with logs
+				cr.req.Header.Set(webswitch.HEADER_REQUEST_ID, s)
+				if retry, off := h.maintenance(cr.req.Host); off {
+					rsp := webswitch.QuickResponse(http.StatusServiceUnavailable, cr.req)
+					if retry != "" {
+						rsp.Header.Set("Retry-After", retry)
+					}
+					cr.reply_ch <- &PlugResponse{rsp, nil}
+					close(cr.reply_ch)
+					log.Printf("maintenance of %s for req#%d", cr.req.Host, h.req_id)
+				} else if _, ok = h.plugs.Hosts[cr.req.Host]; ok {
+					if len(h.pending_reqs) >= *max_pending {
+						h.busy(cr)
+						log.Printf("too many pending, denied req#%d!", h.req_id)
+					} else if pe := h.plugs.alloc(cr.req); pe == nil &&
+						h.plugs.saturated(cr.req.Host, cr.req.ContentLength) {
+						h.busy(cr)
+						log.Printf("plugs of %s saturated, denied req#%d!", cr.req.Host, h.req_id)
+					} else if pe == nil {
+						cr.reply_ch <- &PlugResponse{webswitch.QuickResponse(
+							http.StatusRequestEntityTooLarge, cr.req), nil}
 						close(cr.reply_ch)
 						log.Printf("too big req#%d!", h.req_id)
+					} else if ok, wait := limiter.allow_plug(pe.Conn); !ok {
+						rsp := webswitch.QuickResponse(http.StatusTooManyRequests, cr.req)
+						rsp.Header.Set("Retry-After", retry_after(wait))
+						cr.reply_ch <- &PlugResponse{rsp, nil}
+						close(cr.reply_ch)
+						log.Printf("plug#%d rate limited req#%d!", pe.Conn.Id, h.req_id)
+					} else {
+						log.Println("found plug for", cr.req.Host)
+						// assert the visitor identity for this request only
+						if cr.user != "" && config.IdentityKey != "" {
+							cr.req.Header.Set(webswitch.HEADER_IDENTITY,
+								webswitch.SignIdentity([]byte(config.IdentityKey), cr.user, s,
+									time.Now().Add(webswitch.IDENTITY_TTL)))
+						}
+						// bodies of unknown length stop at the plug limit
+						if lb, ok := cr.req.Body.(*limitBody); ok {
+							lb.limit = pe.Conn.limit
+						}
+						if pe.forward(cr.req) {
+							log.Printf("fwrd req#%d to plug", h.req_id)
+							// keep request id with its reply_ch
+							h.pending_reqs[h.req_id] = cr.reply_ch
+						} else {
+							h.busy(cr)
+							log.Printf("plug queue full for req#%d!", h.req_id)
+						}
 					}
 				} else {
 					// no plug available, deny immediately
-					cr.reply_ch <- errNotFound
+					cr.reply_ch <- &PlugResponse{webswitch.QuickResponse(
+						http.StatusNotFound, cr.req), nil}
 					close(cr.reply_ch)
 					log.Printf("host not found for req#%d!", h.req_id)
 				}
@@ -177,7 +294,7 @@ func (h *Hub) run() {
 					close(ch)
 					log.Printf("rply rsp#%d, %d pending", rspId, len(h.pending_reqs))
 				} else {
-					log.Println("unsolicited rsp: %v", pr.Resp)
+					log.Println("unsolicited rsp:", pr.Resp)
 					pr.Close()
 				}
 			} else {
@@ -204,6 +321,10 @@ func (h *Hub) run() {
 						}
 					}
 					cr.reply_ch <- strconv.FormatInt(int64(count), 10)
+				// query registered host names regardless of ports
+				case CMD_NAME_CNT:
+					count := h.plugs.registered(cr.conn.hosts)
+					cr.reply_ch <- strconv.FormatInt(int64(count), 10)
 				// plug in a conn
 				case CMD_PLUG_IN:
 					count := h.plugs.register(cr.conn)
@@ -217,8 +338,70 @@ func (h *Hub) run() {
 					cr.reply_ch <- strconv.FormatInt(int64(count), 10)
 				// return a dump of the registry status
 				case CMD_PLUG_DUMP:
-					dump, _ := h.plugs.dump(false)
+					dump, _ := h.status(false)
 					cr.reply_ch <- dump
+				// disconnect a plug by id, its reader unregisters it
+				case CMD_PLUG_KICK:
+					count := 0
+					id, _ := strconv.Atoi(cr.args[0])
+					if plug := h.plugs.find(id); plug != nil {
+						plug.ws.Close()
+						count = 1
+					}
+					cr.reply_ch <- strconv.Itoa(count)
+				// stop sending requests to a plug, and disconnect it
+				// after the given seconds unless 0
+				case CMD_PLUG_DRAIN:
+					count := 0
+					id, _ := strconv.Atoi(cr.args[0])
+					wait, _ := strconv.Atoi(cr.args[1])
+					if plug := h.plugs.find(id); plug != nil {
+						plug.draining = true
+						count = 1
+						if wait > 0 {
+							time.AfterFunc(time.Duration(wait)*time.Second, func() {
+								h.command(CMD_PLUG_KICK, cr.args[0])
+							})
+						}
+					}
+					cr.reply_ch <- strconv.Itoa(count)
+				// list registered plugs as JSON
+				case CMD_PLUG_LIST:
+					list, _ := json.Marshal(h.plugs.list())
+					cr.reply_ch <- string(list)
+				// put a vhost in maintenance with optional Retry-After
+				case CMD_HOST_OFF:
+					h.disabled[strings.ToLower(cr.args[0])] = cr.args[1]
+					cr.reply_ch <- "1"
+				// end maintenance of a vhost
+				case CMD_HOST_ON:
+					count := 0
+					if _, ok := h.disabled[strings.ToLower(cr.args[0])]; ok {
+						delete(h.disabled, strings.ToLower(cr.args[0]))
+						count = 1
+					}
+					cr.reply_ch <- strconv.Itoa(count)
+				// set rate limits of a vhost as JSON, "" for defaults,
+				// empty JSON drops limits set before
+				case CMD_SET_RATES:
+					var rates *RateLimits
+					if cr.args[1] != "" {
+						rates = &RateLimits{}
+						if err := json.Unmarshal([]byte(cr.args[1]), rates); err != nil {
+							cr.reply_ch <- err.Error()
+							break
+						}
+					}
+					limiter.set_rates(cr.args[0], rates)
+					cr.reply_ch <- "ok"
+				// drop all pending requests, their visitors get errors
+				case CMD_REQ_PURGE:
+					count := len(h.pending_reqs)
+					for id, ch := range h.pending_reqs {
+						close(ch)
+						delete(h.pending_reqs, id)
+					}
+					cr.reply_ch <- strconv.Itoa(count)
 				default:
 					log.Printf("Unknown command request %v!", cr)
 				}
@@ -234,6 +417,17 @@ func (h *Hub) run() {
 	}
 }
 
+// whether the vhost is in maintenance, returns seconds for Retry-After.
+// Maintenance of a host name applies to its vhosts on any port.
+func (h *Hub) maintenance(vhost string) (string, bool) {
+	vhost = strings.ToLower(vhost)
+	if retry, ok := h.disabled[vhost]; ok {
+		return retry, true
+	}
+	retry, ok := h.disabled[host_name(vhost)]
+	return retry, ok
+}
+
 // PlugResponse contains the plug response including the HTTP response and
 // a chan to end of use. The final consumer of this response shall call the
 // Close() method when the response is no longer needed.
@@ -242,6 +436,22 @@ type PlugResponse struct {
 	_done chan bool      // chan for end of use, use Close()
 }
 
+// whether the response is made by the hub itself, like 404 for vhosts
+// without plugs, rather than coming from a plug
+func (pr *PlugResponse) from_hub() bool {
+	return pr._done == nil
+}
+
+// let the plug reader go on while the response is still in use, once
+// its body no longer needs the plug link
+func (pr *PlugResponse) release() {
+	if pr._done != nil {
+		pr._done <- true
+		// later Close has nobody to tell
+		pr._done = make(chan bool, 1)
+	}
+}
+
 // Close the plug response after use. The response should never be used
 // after this.
 func (pr *PlugResponse) Close() {
@@ -0,0 +1,199 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate of a token bucket
+type Rate struct {
+	PerSec float64 // tokens refilled per second, 0 is unlimited
+	Burst  int     // bucket size, at least 1
+}
+
+// RateLimits of requests, each has its own buckets
+type RateLimits struct {
+	Host   Rate // all requests to one vhost
+	Client Rate // requests from one client IP to one vhost
+	Plug   Rate // requests forwarded to one plug
+}
+
+// bucket size of the rate
+func (r Rate) size() float64 {
+	return math.Max(float64(r.Burst), 1)
+}
+
+// a token bucket
+type bucket struct {
+	Tokens float64   // tokens available at last update
+	last   time.Time // time of last update
+	rate   Rate      // rate at last update
+}
+
+// refill tokens up to now
+func (b *bucket) refill(r Rate, now time.Time) {
+	b.Tokens = math.Min(r.size(), b.Tokens+now.Sub(b.last).Seconds()*r.PerSec)
+	b.last, b.rate = now, r
+}
+
+// RateLimiter keeps token buckets by keys like "host:hp.com",
+// "client:hp.com|1.2.3.4" or "plug:2". It is safe for concurrent use.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time // last time idle buckets are dropped
+	// vhost -> limits set at runtime, "" for the defaults
+	overrides map[string]*RateLimits
+}
+
+// interval to drop full buckets, which are same as missing ones
+const LIMITER_SWEEP_INTERVAL = time.Minute
+
+// the limiter of the hub
+var limiter = &RateLimiter{}
+
+// take a token from the bucket of the key. returns false with the time
+// to wait before retry if the bucket is empty.
+func (rl *RateLimiter) allow(key string, r Rate) (bool, time.Duration) {
+	if r.PerSec <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*bucket)
+	}
+	if now.Sub(rl.swept) > LIMITER_SWEEP_INTERVAL {
+		rl.sweep(now)
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{Tokens: r.size(), last: now}
+		rl.buckets[key] = b
+	}
+	b.refill(r, now)
+	if b.Tokens >= 1 {
+		b.Tokens -= 1
+		return true, 0
+	}
+	wait := time.Duration((1 - b.Tokens) / r.PerSec * float64(time.Second))
+	return false, wait
+}
+
+// drop buckets that have been refilled full
+func (rl *RateLimiter) sweep(now time.Time) {
+	for k, b := range rl.buckets {
+		if b.refill(b.rate, now); b.Tokens >= b.rate.size() {
+			delete(rl.buckets, k)
+		}
+	}
+	rl.swept = now
+}
+
+// available tokens of current buckets, for status output
+func (rl *RateLimiter) state() map[string]float64 {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	st := make(map[string]float64, len(rl.buckets))
+	for k, b := range rl.buckets {
+		b.refill(b.rate, now)
+		st[k] = math.Floor(b.Tokens*100) / 100
+	}
+	return st
+}
+
+// set limits of the vhost at runtime, "" for the defaults. nil drops
+// the limits set before.
+func (rl *RateLimiter) set_rates(vhost string, rates *RateLimits) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.overrides == nil {
+		rl.overrides = make(map[string]*RateLimits)
+	}
+	vhost = strings.ToLower(vhost)
+	if rates == nil {
+		delete(rl.overrides, vhost)
+	} else {
+		rl.overrides[vhost] = rates
+	}
+}
+
+// limits of the vhost, in the order of those set at runtime for the
+// vhost, those configured for the vhost, and the runtime and configured
+// defaults.
+func (rl *RateLimiter) rates(vhost string) *RateLimits {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	vhost = strings.ToLower(vhost)
+	if r, ok := rl.overrides[vhost]; ok && vhost != "" {
+		return r
+	}
+	if r, ok := rl.overrides[host_name(vhost)]; ok && vhost != "" {
+		return r
+	}
+	if r, ok := rl.overrides[""]; ok {
+		if hc := config.host(vhost); hc == nil || hc.Rates == nil {
+			return r
+		}
+	}
+	return config.rates(vhost)
+}
+
+// check the host and client limits of a visitor request.
+// returns false with the time to wait if any is exceeded.
+func (rl *RateLimiter) allow_client(r *http.Request) (bool, time.Duration) {
+	rates := rl.rates(r.Host)
+	// hosts are case insensitive, so are their buckets
+	host := strings.ToLower(r.Host)
+	if ok, wait := rl.allow("host:"+host, rates.Host); !ok {
+		return ok, wait
+	}
+	return rl.allow("client:"+host+"|"+client_ip(r), rates.Client)
+}
+
+// check the limit of a plug
+func (rl *RateLimiter) allow_plug(plug *PlugConn) (bool, time.Duration) {
+	return rl.allow("plug:"+strconv.Itoa(plug.Id), rl.rates("").Plug)
+}
+
+// IP of the visitor. When the peer is a trusted proxy, the last address
+// in Forwarded or X-Forwarded-For not belonging to trusted proxies is taken.
+func client_ip(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !in_nets(ip, config.trusted) {
+		return host
+	}
+	fwd := forwarded_for(r.Header)
+	for i := len(fwd) - 1; i >= 0; i-- {
+		s := fwd[i]
+		fip := net.ParseIP(s)
+		if fip == nil {
+			break
+		}
+		host = s
+		if !in_nets(fip, config.trusted) {
+			break
+		}
+	}
+	return host
+}
+
+// seconds for Retry-After header, at least 1
+func retry_after(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(math.Max(wait.Seconds(), 1))))
+}
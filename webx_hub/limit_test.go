@@ -0,0 +1,94 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_limiter(t *testing.T) {
+	rl := &RateLimiter{}
+	r := Rate{PerSec: 10, Burst: 3}
+
+	// unlimited
+	for i := 0; i < 100; i++ {
+		if ok, _ := rl.allow("a", Rate{}); !ok {
+			t.Fatal("unlimited rate denied")
+		}
+	}
+
+	// burst then deny
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("a", r); !ok {
+			t.Error("denied within burst", i)
+		}
+	}
+	ok, wait := rl.allow("a", r)
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Error("expected deny with wait <= 100ms, got", ok, wait)
+	}
+	// other keys have their own buckets
+	if ok, _ := rl.allow("b", r); !ok {
+		t.Error("denied other key")
+	}
+	// refilled after waiting
+	time.Sleep(wait + 10*time.Millisecond)
+	if ok, _ := rl.allow("a", r); !ok {
+		t.Error("denied after refill")
+	}
+	if st := rl.state(); len(st) != 2 || st["a"] >= 1 {
+		t.Error("unexpected state", st)
+	}
+
+	// full buckets are swept
+	rl.sweep(time.Now().Add(time.Second))
+	if st := rl.state(); len(st) != 0 {
+		t.Error("expected empty state, got", st)
+	}
+
+	// the case of hosts makes no other buckets
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Hosts: map[string]*HostConfig{
+		"www.test": {Rates: &RateLimits{Host: Rate{PerSec: 1, Burst: 1}}}}}
+	if ok, _ := rl.allow_client(&http.Request{Host: "WWW.Test", Header: http.Header{}}); !ok {
+		t.Error("denied first request")
+	}
+	if ok, _ := rl.allow_client(&http.Request{Host: "www.test", Header: http.Header{}}); ok {
+		t.Error("expected deny of same host in other case")
+	}
+}
+
+func Test_client_ip(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{}
+	var err error
+	if config.trusted, err = parse_cidrs([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		remote, fwd, want string
+	}{
+		{"1.2.3.4:5678", "", "1.2.3.4"},
+		{"1.2.3.4:5678", "6.6.6.6", "1.2.3.4"},
+		{"10.1.1.1:80", "", "10.1.1.1"},
+		{"10.1.1.1:80", "6.6.6.6, 7.7.7.7", "7.7.7.7"},
+		{"10.1.1.1:80", "6.6.6.6, 7.7.7.7, 192.168.1.1", "7.7.7.7"},
+		{"10.1.1.1:80", "junk, 10.2.2.2", "10.2.2.2"},
+		{"192.168.1.2:80", "6.6.6.6", "192.168.1.2"},
+	} {
+		r := &http.Request{RemoteAddr: c.remote, Header: http.Header{}}
+		if c.fwd != "" {
+			r.Header.Set("X-Forwarded-For", c.fwd)
+		}
+		if got := client_ip(r); got != c.want {
+			t.Errorf("%s %q: expected %s got %s", c.remote, c.fwd, c.want, got)
+		}
+	}
+}
@@ -2,59 +2,114 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package main
+package webx_hub
 
 import (
 	"flag"
 	"github.com/yf13/webswitch"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
-// version of frontend switch
-const APP_VERSION = "0.1"
-
-// command line options
+// command line options, parsed by Main
 var (
-	cert_file   = flag.String("cert", "", "public cert file (.pem) w/ CA and SANs")
-	key_file    = flag.String("key", "", "private key file (.pem)")
-	hub_path    = flag.String("path", webswitch.HUB_RESOURCE_NAME, "hub resource path.")
-	http_ports  = flag.String("http_ports", ":8080", "comma separated ports for http clients.")
-	https_ports = flag.String("https_ports", ":8443", "comma separated ports for https clients.")
-	plug_port   = flag.String("plug", ":8081", "port for plugs.")
-	//auth_plugs  = flag.Bool("auth", false, "whether to challenge plugs")
+	flags        = flag.NewFlagSet("hub", flag.ExitOnError)
+	cert_file    = flags.String("cert", "", "public cert file (.pem) w/ CA and SANs")
+	key_file     = flags.String("key", "", "private key file (.pem)")
+	hub_path     = flags.String("path", webswitch.HUB_RESOURCE_NAME, "hub resource path.")
+	http_ports   = flags.String("http_ports", ":8080", "comma separated ports for http clients.")
+	https_ports  = flags.String("https_ports", ":8443", "comma separated ports for https clients.")
+	tls_ports    = flags.String("tls_passthrough", "", "comma separated ports passing TLS unterminated to plugs by SNI.")
+	plug_port    = flags.String("plug", ":8081", "port for plugs.")
+	admin_port   = flags.String("admin", "", "address of the admin API (e.g. '127.0.0.1:8082'), needs AdminToken in config.")
+	config_file  = flags.String("config", "", "hub config file (.json) for hosts, rate limits, etc.")
+	allow_h2c    = flags.Bool("h2c", true, "accept HTTP/2 without TLS (h2c) on http ports.")
+	proxy_proto  = flags.Bool("proxy_protocol", false, "accept PROXY protocol v1/v2 headers from TrustedProxies on http/https ports.")
+	link_deflate = flags.Bool("link_deflate", true, "compress plug link messages with per-message deflate if plugs agree.")
+	certs_dir    = flags.String("certs", "", "dir of per site cert pairs (name.crt, name.key, optional name.ocsp) selected by SNI")
+	certs_poll   = flags.Duration("certs_poll", time.Minute, "interval to reload changed certs, 0 disables.")
+	acme_hosts   = flags.String("acme_hosts", "", "comma separated allowlist of hosts to get ACME certs for (e.g. 'hp.com,*.ibm.com')")
+	acme_url     = flags.String("acme_url", autocert.DefaultACMEDirectory, "ACME directory URL.")
+	acme_cache   = flags.String("acme_cache", "acme-cache", "dir to cache ACME account and certs.")
+	acme_email   = flags.String("acme_email", "", "contact email for the ACME account.")
+	acme_ca      = flags.String("acme_ca", "", "root CA pem to trust the ACME server (e.g. pebble.minica.pem)")
+	plug_queue   = flags.Int("plug_queue", OUT_BUFFER_LENGTH, "requests queued for each plug, others go to less busy plugs.")
+	max_pending  = flags.Int("max_pending", MAX_PENDING, "cap of requests waiting for plug replies, beyond which visitors get 503.")
+	//auth_plugs  = flags.Bool("auth", false, "whether to challenge plugs")
 )
 
-// program entrance
-func main() {
+// run the hub with command line args, like "webx hub -config hub.json"
+func Main(args []string) {
 
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds | log.Ldate)
-	flag.Parse()
+	flags.Parse(args)
 
-	log.Println("version:", APP_VERSION)
+	log.Println("version:", webswitch.APP_VERSION)
 
-	secured := len(*cert_file) > 0 && len(*key_file) > 0
+	if len(*config_file) > 0 {
+		cfg, err := LoadConfig(*config_file)
+		if err != nil {
+			log.Fatal("error config: ", err)
+		}
+		config = cfg
+		log.Println("config: ", *config_file)
+	}
 
-	// check key files
+	// load certificates and keep them fresh
+	var certs *CertStore
+	if (len(*cert_file) > 0 && len(*key_file) > 0) || len(*certs_dir) > 0 {
+		var err error
+		if certs, err = NewCertStore(*cert_file, *key_file, *certs_dir); err != nil {
+			log.Fatal("error certs: ", err)
+		}
+		go certs.watch(*certs_poll)
+	}
+	// obtain certificates through ACME for allowed published hosts
+	var issuer *AcmeIssuer
+	if len(*acme_hosts) > 0 {
+		var err error
+		issuer, err = NewAcmeIssuer(*acme_url, *acme_cache, *acme_email,
+			*acme_ca, *acme_hosts)
+		if err != nil {
+			log.Fatal("error acme: ", err)
+		}
+		log.Println("acme: ", *acme_url)
+	}
+	secured := certs != nil || issuer != nil
 
 	// start client listeners with default server mux
 	http.HandleFunc("/", handleClient)
+	var visitors http.Handler = http.DefaultServeMux
+	if issuer != nil {
+		visitors = issuer.http_handler(visitors)
+	}
+	plain := visitors
+	if *allow_h2c {
+		plain = h2c.NewHandler(visitors, &http2.Server{})
+	}
 	if len(*http_ports) > 0 {
 		for _, port := range strings.Split(*http_ports, ",") {
 			log.Println("http port: ", port)
+			l := visitor_listener(port)
 			go func() {
 				log.Fatal(
-					http.ListenAndServe(port, nil))
+					http.Serve(l, plain))
 			}()
 		}
 	}
 	if secured && len(*https_ports) > 0 {
 		for _, port := range strings.Split(*https_ports, ",") {
 			log.Println("https port: ", port)
+			srv := &http.Server{Addr: port, TLSConfig: visitor_tls_config(certs, issuer)}
+			l := visitor_listener(port)
 			go func() {
-				log.Fatal(
-					http.ListenAndServeTLS(port, *cert_file, *key_file, nil))
+				log.Fatal(srv.ServeTLS(l, "", ""))
 			}()
 		}
 	}
@@ -62,17 +117,68 @@ func main() {
 	// start the hub
 	go hub.run()
 
+	// negotiate compression of the link with plugs
+	upgrader.EnableCompression = *link_deflate
+
+	// start TLS passthrough listeners
+	if len(*tls_ports) > 0 {
+		for _, port := range strings.Split(*tls_ports, ",") {
+			l := visitor_listener(port)
+			log.Println("tls passthrough port: ", port)
+			go func() {
+				log.Fatal(serve_passthrough(l))
+			}()
+		}
+	}
+
+	// start tunneled service listeners
+	for name, addr := range config.Tunnels {
+		l := visitor_listener(addr)
+		log.Println("tunnel port: ", addr, name)
+		go func(name string) {
+			log.Fatal(serve_tunnel(l, name))
+		}(name)
+	}
+
+	// start the admin API on its own listener
+	if len(*admin_port) > 0 {
+		if config.AdminToken == "" {
+			log.Fatal("error admin: AdminToken not configured")
+		}
+		log.Println("admin port: ", *admin_port)
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin_port, admin_mux()))
+		}()
+	}
+
 	// start plug port on its own server mux, special case
 	// if plug port same as http/https port, listen will fail now.
 	smuxPlug := http.NewServeMux()
 	smuxPlug.HandleFunc(*hub_path, handlePlug)
+	smuxPlug.HandleFunc(*hub_path+webswitch.HUB_TUNNEL_PATH, handleTunnel)
 	//http.HandleFunc(*hub_path, handlePlug)
 	if !secured {
 		log.Println("insecure plug: ", *plug_port+*hub_path)
 		log.Fatal("ListenAndServe: ", http.ListenAndServe(*plug_port, smuxPlug))
 	} else {
 		log.Println("secure plug: ", *plug_port+*hub_path)
-		log.Fatal("ListenAndServeTLS: ", http.ListenAndServeTLS(*plug_port,
-			*cert_file, *key_file, smuxPlug))
+		srv := &http.Server{Addr: *plug_port, Handler: smuxPlug,
+			TLSConfig: visitor_tls_config(certs, issuer)}
+		log.Fatal("ListenAndServeTLS: ", srv.ListenAndServeTLS("", ""))
+	}
+}
+
+// listen on a visitor or tunnel port, with PROXY protocol headers if enabled
+func visitor_listener(port string) net.Listener {
+	l, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatal("error listen: ", err)
+	}
+	if *proxy_proto {
+		if len(config.trusted) == 0 {
+			log.Println("warn: PROXY protocol needs TrustedProxies in config")
+		}
+		l = &proxyListener{l}
 	}
+	return l
 }
@@ -0,0 +1,112 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// time for visitors to send their TLS ClientHello
+const SNI_TIMEOUT = 5 * time.Second
+
+// error to stop the handshake once the ClientHello is read
+var errSniRead = errors.New("sni read")
+
+// accept TLS visitors on the listener and pass their streams, still
+// encrypted, to plugs registered for the SNI name. Real hosts of the name
+// are "tcp://" ones holding the certificate.
+func serve_passthrough(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go pass_through(c)
+	}
+}
+
+// tunnel the TLS conn to a plug by its SNI name
+func pass_through(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(SNI_TIMEOUT))
+	sni, hello, err := peek_sni(c)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println("error passthrough from", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	// tunneled services have own listeners, not to be reached by name
+	if config.tunneled(sni) {
+		log.Println("error passthrough from", c.RemoteAddr(), "to tunneled", sni)
+		c.Close()
+		return
+	}
+	log.Println("passthrough", sni, "for", c.RemoteAddr())
+	open_tunnel(&replayConn{c, io.MultiReader(bytes.NewReader(hello), c)}, sni)
+}
+
+// read the ClientHello of a TLS conn, returns its SNI name and the bytes
+// read, which the real host needs before the rest of the stream
+func peek_sni(c net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	sni := ""
+	err := tls.Server(&readOnlyConn{io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSniRead
+		},
+	}).Handshake()
+	if sni == "" {
+		if err == nil || err == errSniRead {
+			err = errors.New("no SNI")
+		}
+		return "", nil, err
+	}
+	return strings.ToLower(sni), buf.Bytes(), nil
+}
+
+// readOnlyConn feeds a TLS handshake from a reader, dropping its writes
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn reads bytes peeked already before the rest of the conn
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// half-close the underlying conn if it can
+func (c *replayConn) CloseWrite() error {
+	return close_write(c.Conn)
+}
+
+// half-close the conn if it can
+func close_write(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
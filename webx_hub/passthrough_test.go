@@ -0,0 +1,79 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_peek_sni(t *testing.T) {
+	dir := t.TempDir()
+	write_test_pair(t, dir, "s", "secure.test")
+	crt, err := tls.LoadX509KeyPair(filepath.Join(dir, "s"+CERT_FILE_EXT), filepath.Join(dir, "s"+KEY_FILE_EXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		c := tls.Client(a, &tls.Config{ServerName: "Secure.Test", InsecureSkipVerify: true})
+		if err := c.Handshake(); err == nil {
+			c.Write([]byte("hello"))
+		}
+	}()
+	sni, hello, err := peek_sni(b)
+	if err != nil || sni != "secure.test" || len(hello) == 0 || hello[0] != 0x16 {
+		t.Fatal("unexpected sni", sni, len(hello), err)
+	}
+	// the real host completes the handshake with the replayed hello
+	srv := tls.Server(&replayConn{b, io.MultiReader(bytes.NewReader(hello), b)},
+		&tls.Config{Certificates: []tls.Certificate{crt}})
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(srv, buf); err != nil || string(buf) != "hello" {
+		t.Error("expected hello, got", string(buf), err)
+	}
+
+	// plain text is refused
+	a, b = net.Pipe()
+	go func() {
+		a.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		a.Close()
+	}()
+	if _, _, err := peek_sni(b); err == nil {
+		t.Error("expected error for plain text")
+	}
+	ioutil.ReadAll(b)
+}
+
+func Test_passthrough_tunneled(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &HubConfig{Tunnels: map[string]string{"ssh": ":2222"}}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go tls.Client(a, &tls.Config{ServerName: "SSH", InsecureSkipVerify: true}).Handshake()
+	done := make(chan bool)
+	go func() {
+		pass_through(b)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected tunneled name refused")
+	}
+	if _, err := b.Write([]byte("x")); err == nil {
+		t.Error("expected conn closed")
+	}
+}
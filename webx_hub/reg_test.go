@@ -2,16 +2,19 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package main
+package webx_hub
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 func Test_regs(t *testing.T) {
 	hosts := []string{"ibm.com", "hp.com", "dell.com", "java.cn"}
-	pc1 := &PlugConn{hosts[:2], nil, nil, 5000, 0, 0, 0}
-	pc2 := &PlugConn{hosts[1:3], nil, nil, 0, 0, 0, 0}
+	pc1 := &PlugConn{hosts: hosts[:2], limit: 5000}
+	pc2 := &PlugConn{hosts: hosts[1:3]}
 
 	reg := PlugRegistry{}
 
@@ -103,3 +106,99 @@ func Test_regs(t *testing.T) {
 	}
 
 }
+
+func Test_registered(t *testing.T) {
+	pc := &PlugConn{hosts: []string{"ibm.com:8080", "HP.com"}}
+	reg := PlugRegistry{}
+	if n := reg.registered([]string{"ibm.com"}); n != 0 {
+		t.Error(n, "!=", 0)
+	}
+	reg.register(pc)
+	for names, want := range map[string]int{
+		"ibm.com":         1,
+		"hp.com":          1,
+		"IBM.com,hp.com":  2,
+		"dell.com":        0,
+		"ibm.com:8080":    0,
+		"dell.com,hp.com": 1,
+	} {
+		if n := reg.registered(strings.Split(names, ",")); n != want {
+			t.Error(names, n, "!=", want)
+		}
+	}
+}
+
+func Test_draining(t *testing.T) {
+	pc1 := &PlugConn{hosts: []string{"ibm.com"}}
+	pc2 := &PlugConn{hosts: []string{"ibm.com"}, limit: 100}
+	reg := PlugRegistry{}
+	reg.register(pc1)
+	reg.register(pc2)
+	pc2.draining = true
+	if pe := reg.alloc_params("ibm.com", 10); pe == nil || pe.Conn != pc1 {
+		t.Error("expected", pc1, "got", pe)
+	}
+	pc1.draining = true
+	if pe := reg.alloc_params("ibm.com", 10); pe != nil {
+		t.Error("expected nil but got", pe)
+	}
+	if list := reg.list(); len(list) != 2 || !list[0].Draining || list[0].Limit != 0 {
+		t.Error("unexpected list", list)
+	}
+}
+
+func Test_unknown_size(t *testing.T) {
+	pc1 := &PlugConn{hosts: []string{"ibm.com"}, limit: 100}
+	pc2 := &PlugConn{hosts: []string{"ibm.com"}, limit: 5000}
+	reg := PlugRegistry{}
+	reg.register(pc1)
+	reg.register(pc2)
+	if pe := reg.alloc_params("ibm.com", -1); pe == nil || pe.Conn != pc2 {
+		t.Error("expected largest limit", pc2, "got", pe)
+	}
+	pc3 := &PlugConn{hosts: []string{"ibm.com"}}
+	reg.register(pc3)
+	if pe := reg.alloc_params("ibm.com", -1); pe == nil || pe.Conn != pc3 {
+		t.Error("expected unlimited", pc3, "got", pe)
+	}
+}
+
+func Test_saturated(t *testing.T) {
+	pc1 := &PlugConn{hosts: []string{"ibm.com"}, obuf: make(chan *http.Request, 1)}
+	pc2 := &PlugConn{hosts: []string{"ibm.com"}, obuf: make(chan *http.Request, 1)}
+	reg := PlugRegistry{}
+	reg.register(pc1)
+	reg.register(pc2)
+	req := httptest.NewRequest("GET", "http://ibm.com/", nil)
+	// the turn moves on between plugs of a bundle
+	first := reg.alloc_params("ibm.com", 10)
+	if first == nil || !first.forward(req) {
+		t.Fatal("expected a plug for the first request")
+	}
+	second := reg.alloc_params("ibm.com", 10)
+	if second == nil || second.Conn == first.Conn || !second.forward(req) {
+		t.Fatal("expected the other plug, got", second)
+	}
+	// full queues are skipped and never block
+	if pe := reg.alloc_params("ibm.com", 10); pe != nil {
+		t.Error("expected nil but got", pe)
+	}
+	if first.forward(req) {
+		t.Error("forward to a full queue")
+	}
+	if !reg.saturated("ibm.com", 10) || reg.saturated("hp.com", 10) {
+		t.Error("unexpected saturation")
+	}
+	if list := reg.list(); len(list) != 2 || list[0].Queued != 1 {
+		t.Error("unexpected list", list)
+	}
+	<-pc1.obuf
+	if pe := reg.alloc_params("ibm.com", 10); pe == nil || pe.Conn != pc1 {
+		t.Error("expected", pc1, "got", pe)
+	}
+	pc1.draining = true
+	pc2.draining = true
+	if reg.saturated("ibm.com", 10) {
+		t.Error("draining plugs taken as saturated")
+	}
+}
@@ -2,15 +2,17 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package main
+package webx_hub
 
 import (
 	"encoding/json"
 	"log"
 	"math"
+	"net"
 	"net/http"
-	"strconv"
-	"github.com/yf13/webswitch"
+	"sort"
+	"strings"
+	"time"
 )
 
 // a plug entry with a use count. Note this count is different from the one
@@ -22,18 +24,27 @@ type PlugEntry struct {
 	Conn *PlugConn // underlying conn, shared among multiple vhosts
 }
 
-// forward HTTP client req to the plug and update the use counters
+// forward HTTP client req to the plug and update the use counters, it
+// never blocks and fails if the plug queue is full
 func (pe *PlugEntry) forward(req *http.Request) bool {
 	success := false
 	if pe.Conn != nil && pe.Conn.obuf != nil && req != nil {
-		pe.Conn.obuf <- req
-		pe.Conn.uses += 1
-		pe.Uses += 1
-		success = true
+		select {
+		case pe.Conn.obuf <- req:
+			pe.Conn.uses += 1
+			pe.Uses += 1
+			success = true
+		default:
+		}
 	}
 	return success
 }
 
+// whether the plug takes requests now, not draining nor with a full queue
+func (c *PlugConn) ready() bool {
+	return !c.draining && (c.obuf == nil || len(c.obuf) < cap(c.obuf))
+}
+
 // The bundle of plugs with the same limit for the same vhost,
 // The plugs in the bundle should be used equally, A simple round robin
 // usage managed by a "next" index can be a starting point.
@@ -118,6 +129,7 @@ func (reg *PlugRegistry) register(plug *PlugConn) int {
 		// assign conn id for the plug to mark it is registered
 		reg.plug_id += 1
 		plug.Id = reg.plug_id
+		plug.birth = time.Now().Unix()
 		reg.num_plugs += 1
 
 		log.Println("plugged in: ", plug)
@@ -199,15 +211,30 @@ func (reg *PlugRegistry) unregister(plug *PlugConn) int {
 	return dropped
 }
 
-// find a plug proper to handle given message size
-// when no proper entry exist, nil will be returned
+// find a plug proper to handle given message size, draining plugs and
+// those with full queues are skipped. unknown sizes, given as negative,
+// go to the plugs of largest limit, unlimited ones first. when no proper
+// entry exist, nil will be returned
 func (reg *PlugRegistry) alloc_params(host string, size int64) *PlugEntry {
 	var plug *PlugEntry = nil
 	if pbl, ok := reg.Hosts[host]; ok && len(pbl) > 0 {
-		for _, pb := range pbl {
-			if pb.Limit >= size && len(pb.Plugs) > 0 {
-				plug = &pb.Plugs[pb.next%len(pb.Plugs)]
-				pb.next = (pb.next + 1) % len(pb.Plugs)
+		for j := range pbl {
+			// the bundle itself, so that its turn moves on
+			pb := &pbl[j]
+			if size < 0 {
+				pb = &pbl[len(pbl)-1-j]
+			} else if pb.Limit < size {
+				continue
+			}
+			for i := range pb.Plugs {
+				pe := &pb.Plugs[(pb.next+i)%len(pb.Plugs)]
+				if pe.Conn == nil || pe.Conn.ready() {
+					plug = pe
+					pb.next = (pb.next + i + 1) % len(pb.Plugs)
+					break
+				}
+			}
+			if plug != nil {
 				break
 			}
 		}
@@ -215,19 +242,108 @@ func (reg *PlugRegistry) alloc_params(host string, size int64) *PlugEntry {
 	return plug
 }
 
+// whether plugs of the host could take a message of the size but are
+// all busy with full queues, rather than too small or draining
+func (reg *PlugRegistry) saturated(host string, size int64) bool {
+	for _, pb := range reg.Hosts[host] {
+		if size >= 0 && pb.Limit < size {
+			continue
+		}
+		for _, pe := range pb.Plugs {
+			if pe.Conn != nil && !pe.Conn.draining {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // allocate a plug proper to forward the given HTTP request
 // when no proper entry exist, nil will be returned
 func (reg *PlugRegistry) alloc(req *http.Request) *PlugEntry {
 	var plug *PlugEntry = nil
 	if req != nil {
-		size, _ := strconv.ParseInt(
-			req.Header.Get(webswitch.HEADER_CONTENT_LEN), 10, 64)
-		plug = reg.alloc_params(req.Host, size)
+		// -1 if unknown, e.g. chunked
+		plug = reg.alloc_params(req.Host, req.ContentLength)
 	}
 	return plug
 }
 
-// query number of registered hosts
-func (reg *PlugRegistry) registered(hosts []string) int {
-	return 0
+// query number of given host names having registered vhosts. Ports of
+// vhosts are ignored, e.g. name "hp.com" matches vhost "hp.com:8080".
+func (reg *PlugRegistry) registered(names []string) int {
+	count := 0
+	for _, n := range names {
+		n = strings.ToLower(n)
+		for vhost := range reg.Hosts {
+			if strings.ToLower(host_name(vhost)) == n {
+				count += 1
+				break
+			}
+		}
+	}
+	return count
+}
+
+// host name of a vhost, without port
+func host_name(vhost string) string {
+	if h, _, err := net.SplitHostPort(vhost); err == nil {
+		return h
+	}
+	return vhost
+}
+
+// find the registered plug conn by id, nil if not found
+func (reg *PlugRegistry) find(id int) *PlugConn {
+	for _, pbl := range reg.Hosts {
+		for _, pb := range pbl {
+			for _, pe := range pb.Plugs {
+				if pe.Conn.Id == id {
+					return pe.Conn
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PlugInfo describes a registered plug conn
+type PlugInfo struct {
+	Id       int
+	Hosts    []string
+	Limit    int64  // message limit, 0 is unlimited
+	Uses     uint64 // requests forwarded
+	Birth    int64  // unix time of registration
+	Remote   string // address of the plug
+	Stream   bool   // whether messages are streamed
+	Draining bool   // whether the plug gets no more requests
+	Queued   int    // requests waiting to be sent to the plug
+}
+
+// list the registered plug conns by id
+func (reg *PlugRegistry) list() []PlugInfo {
+	seen := make(map[int]bool)
+	list := []PlugInfo{}
+	for _, pbl := range reg.Hosts {
+		for _, pb := range pbl {
+			for _, pe := range pb.Plugs {
+				c := pe.Conn
+				if seen[c.Id] {
+					continue
+				}
+				seen[c.Id] = true
+				pi := PlugInfo{Id: c.Id, Hosts: c.hosts, Limit: c.limit, Uses: c.uses, Birth: c.birth,
+					Stream: c.stream, Draining: c.draining, Queued: len(c.obuf)}
+				if pi.Limit == math.MaxInt64 {
+					pi.Limit = 0
+				}
+				if c.ws != nil {
+					pi.Remote = c.ws.RemoteAddr().String()
+				}
+				list = append(list, pi)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
 }
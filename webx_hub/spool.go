@@ -0,0 +1,216 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"github.com/yf13/webswitch"
+)
+
+// spool defaults
+const (
+	SPOOL_MEM_BYTES = 256 * 1024       // bytes of a body held in memory
+	SPOOL_MAX_BYTES = 64 * 1024 * 1024 // bytes of a body spooled at most
+)
+
+// SpoolConfig enables spooling of bodies at the hub, in memory then in
+// temp files, so that slow visitors don't hold plug links. Bodies beyond
+// MaxBytes, or beyond TotalBytes of all bodies in flight, are spooled up
+// to there and stream the rest.
+type SpoolConfig struct {
+	Requests   bool   // read request bodies before sending them to plugs
+	Responses  bool     // read response bodies, except streams, before sending them to visitors
+	MemBytes   int64    // bytes of a body held in memory, SPOOL_MEM_BYTES if 0
+	MaxBytes   int64    // bytes of a body spooled at most, SPOOL_MAX_BYTES if 0
+	TotalBytes int64    // bytes of all bodies in flight spooled at most, unlimited if 0
+	Dir        string   // dir of temp files, the system one if empty
+	Streams    []string // more content type prefixes of streams, not spooled
+
+	used int64 // bytes of bodies in flight
+}
+
+// spool settings of the vhost, nil if disabled
+func (cfg *HubConfig) spool(vhost string) *SpoolConfig {
+	if hc := cfg.host(vhost); hc != nil && hc.Spool != nil {
+		return hc.Spool
+	}
+	return cfg.Spool
+}
+
+// spoolBody reads the spooled bytes, then the rest of the original body
+// if it was too big. Closing it drops the temp file.
+type spoolBody struct {
+	io.Reader
+	sc   *SpoolConfig
+	orig io.Closer
+	file *os.File // temp file, nil if all in memory
+	size int64    // bytes spooled
+}
+
+func (sb *spoolBody) Close() error {
+	if sb.file != nil {
+		sb.file.Close()
+		os.Remove(sb.file.Name())
+		sb.file = nil
+	}
+	atomic.AddInt64(&sb.sc.used, -sb.size)
+	sb.size = 0
+	return sb.orig.Close()
+}
+
+// reserve room for n more bytes in flight, false if the total is reached
+func (sc *SpoolConfig) reserve(n int64) bool {
+	if atomic.AddInt64(&sc.used, n) > sc.TotalBytes && sc.TotalBytes > 0 {
+		atomic.AddInt64(&sc.used, -n)
+		return false
+	}
+	return true
+}
+
+// read the body into the spool. returns the spooled body and whether
+// it is all in, so the original body is done.
+func (sc *SpoolConfig) take(body io.ReadCloser) (*spoolBody, bool, error) {
+	mem_bytes, max_bytes := sc.MemBytes, sc.MaxBytes
+	if mem_bytes <= 0 {
+		mem_bytes = SPOOL_MEM_BYTES
+	}
+	if max_bytes <= 0 {
+		max_bytes = SPOOL_MAX_BYTES
+	}
+	sb := &spoolBody{sc: sc, orig: body}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	chunk := make([]byte, webswitch.STREAM_SEGMENT_SIZE)
+	done := false
+	for sb.size < max_bytes {
+		n, err := body.Read(chunk[:min(int64(len(chunk)), max_bytes-sb.size)])
+		if n > 0 {
+			if !sc.reserve(int64(n)) {
+				// no room, the rest streams
+				sb.Reader = io.MultiReader(sb.spooled(&buf), bytes.NewReader(chunk[:n]), body)
+				return sb, false, nil
+			}
+			sb.size += int64(n)
+			if sb.file == nil && int64(buf.Len()+n) > mem_bytes {
+				if sb.file, err = ioutil.TempFile(sc.Dir, "webx-spool-"); err != nil {
+					sb.Close()
+					return nil, false, err
+				}
+				w = sb.file
+			}
+			if _, werr := w.Write(chunk[:n]); werr != nil {
+				sb.Close()
+				return nil, false, werr
+			}
+		}
+		if err == io.EOF {
+			done = true
+			break
+		} else if err != nil {
+			sb.Close()
+			return nil, false, err
+		}
+	}
+	if done {
+		sb.Reader = sb.spooled(&buf)
+	} else {
+		sb.Reader = io.MultiReader(sb.spooled(&buf), body)
+	}
+	return sb, done, nil
+}
+
+// reader of the spooled bytes, memory first
+func (sb *spoolBody) spooled(buf *bytes.Buffer) io.Reader {
+	if sb.file == nil {
+		return buf
+	}
+	if _, err := sb.file.Seek(0, io.SeekStart); err != nil {
+		log.Println("error spool:", err)
+	}
+	return io.MultiReader(buf, sb.file)
+}
+
+// spool the request body, small ones of unknown length get known
+func (sc *SpoolConfig) spool_request(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil
+	}
+	sb, done, err := sc.take(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = sb
+	if done && r.ContentLength < 0 {
+		r.ContentLength = sb.size
+		r.TransferEncoding = nil
+		r.Header.Set(webswitch.HEADER_CONTENT_LEN, strconv.FormatInt(sb.size, 10))
+	}
+	return nil
+}
+
+// content types of responses that stream, like event streams and gRPC
+var STREAM_TYPES = []string{"text/event-stream", "application/grpc"}
+
+// whether the response is a stream, to pass as it comes
+func (sc *SpoolConfig) stream(rsp *http.Response) bool {
+	ct := strings.ToLower(rsp.Header.Get("Content-Type"))
+	for _, types := range [][]string{STREAM_TYPES, sc.Streams} {
+		for _, t := range types {
+			if strings.HasPrefix(ct, strings.ToLower(t)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spool the response body of the plug, if it is all in the plug link
+// is released. Streams pass as they come; bodies of unknown length, like
+// chunked ones, are spooled up to the caps.
+func (sc *SpoolConfig) spool_response(pr *PlugResponse) error {
+	rsp := pr.Resp
+	if rsp.Body == nil || rsp.Body == http.NoBody || rsp.ContentLength == 0 || sc.stream(rsp) {
+		return nil
+	}
+	sb, done, err := sc.take(rsp.Body)
+	if err != nil {
+		return err
+	}
+	rsp.Body = sb
+	if done {
+		pr.release()
+	}
+	return nil
+}
+
+// check the settings
+func (sc *SpoolConfig) check() error {
+	if sc.Dir != "" {
+		if fi, err := os.Stat(sc.Dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return errors.New("spool dir is no dir: " + sc.Dir)
+		}
+	}
+	return nil
+}
+
+// status of requests failed to spool, temp file errors are ours
+func spool_status(err error) int {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
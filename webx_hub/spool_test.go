@@ -0,0 +1,102 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_spool(t *testing.T) {
+	dir := t.TempDir()
+	sc := &SpoolConfig{Requests: true, Responses: true, MemBytes: 10, MaxBytes: 100, Dir: dir}
+	body := strings.Repeat("0123456789", 5)
+
+	// response in memory and file, the plug is released
+	pr := test_response(200, body)
+	done := pr._done
+	if err := sc.spool_response(pr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("expected plug released")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || sc.used != 50 {
+		t.Error("expected 1 spool file and 50 used, got", len(files), sc.used)
+	}
+	if b, _ := ioutil.ReadAll(pr.Resp.Body); string(b) != body {
+		t.Error("bad spooled body", string(b))
+	}
+	pr.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 || sc.used != 0 {
+		t.Error("expected spool dropped, got", len(files), sc.used)
+	}
+
+	// chunked response is spooled too, the plug is released
+	pr = test_response(200, body)
+	pr.Resp.ContentLength = -1
+	done = pr._done
+	if err := sc.spool_response(pr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("expected plug released for chunked response")
+	}
+	if b, _ := ioutil.ReadAll(pr.Resp.Body); string(b) != body {
+		t.Error("bad spooled body", string(b))
+	}
+	pr.Close()
+
+	// streams pass as they come
+	sc.Streams = []string{"application/x-ndjson"}
+	for _, ct := range []string{"text/event-stream", "application/grpc+proto", "application/x-ndjson"} {
+		pr = test_response(200, body, "Content-Type", ct)
+		pr.Resp.ContentLength = -1
+		orig := pr.Resp.Body
+		if sc.spool_response(pr); pr.Resp.Body != orig {
+			t.Error("expected stream not spooled", ct)
+		}
+		pr.Close()
+	}
+
+	// request of unknown length beyond the total, the rest streams
+	sc.TotalBytes = 40
+	r := httptest.NewRequest("POST", "http://www.test/", strings.NewReader(body))
+	r.ContentLength = -1
+	if err := sc.spool_request(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ContentLength != -1 || sc.used > 40 {
+		t.Error("expected partly spooled, got", r.ContentLength, sc.used)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+		t.Error("bad spooled body", string(b))
+	}
+	r.Body.Close()
+
+	// small request gets known
+	sc.TotalBytes = 0
+	r = httptest.NewRequest("POST", "http://www.test/", strings.NewReader("small"))
+	r.ContentLength = -1
+	if sc.spool_request(r); r.ContentLength != 5 || r.Header.Get("Content-Length") != "5" {
+		t.Error("expected known length, got", r.ContentLength)
+	}
+	r.Body.Close()
+
+	if (&SpoolConfig{Dir: dir + "/missing"}).check() == nil {
+		t.Error("expected error for missing dir")
+	}
+	os.WriteFile(dir+"/file", nil, 0600)
+	if (&SpoolConfig{Dir: dir + "/file"}).check() == nil {
+		t.Error("expected error for file as dir")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/yf13/webswitch"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time for plugs to connect tunnels back
+const TUNNEL_DIAL_TIMEOUT = 10 * time.Second
+
+// TunnelTable keeps tunnels waiting for plugs to connect back, by tokens
+// given to plugs in CONNECT requests. It is safe for concurrent use.
+type TunnelTable struct {
+	mu      sync.Mutex
+	waiting map[string]chan *websocket.Conn
+}
+
+// tunnels of the hub
+var tunnels = &TunnelTable{waiting: make(map[string]chan *websocket.Conn)}
+
+// add a waiting tunnel, returns its token and the chan to get its websocket
+func (tt *TunnelTable) add() (string, chan *websocket.Conn) {
+	token, ch := random_token(), make(chan *websocket.Conn, 1)
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.waiting[token] = ch
+	return token, ch
+}
+
+// take the waiting tunnel of the token, nil if none
+func (tt *TunnelTable) take(token string) chan *websocket.Conn {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	ch := tt.waiting[token]
+	delete(tt.waiting, token)
+	return ch
+}
+
+// whether a tunnel waits for the token
+func (tt *TunnelTable) waits(token string) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	_, ok := tt.waiting[token]
+	return ok
+}
+
+// pass the websocket to the tunnel waiting for the token, false if it
+// no longer waits. done with the lock held, so cancel never misses it.
+func (tt *TunnelTable) give(token string, ws *websocket.Conn) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	ch := tt.waiting[token]
+	delete(tt.waiting, token)
+	if ch != nil {
+		ch <- ws
+	}
+	return ch != nil
+}
+
+// stop waiting for the token, closing a websocket given but not used
+func (tt *TunnelTable) cancel(token string, ch chan *websocket.Conn) {
+	tt.take(token)
+	select {
+	case ws := <-ch:
+		ws.Close()
+	default:
+	}
+}
+
+// accept visitors of the service on the listener and tunnel them to plugs
+// registered for it
+func serve_tunnel(l net.Listener, name string) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go open_tunnel(c, name)
+	}
+}
+
+// ask a plug of the name to connect back a tunnel, then pipe the conn
+// through it. Access rules and rate limits of the name apply.
+func open_tunnel(c net.Conn, name string) {
+	defer c.Close()
+	req := &http.Request{Method: "CONNECT", Host: name, URL: &url.URL{Host: name},
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{},
+		Body: http.NoBody, RemoteAddr: c.RemoteAddr().String()}
+	if !access_allowed(req) {
+		log.Println("access denied", name, client_ip(req))
+		return
+	}
+	if ok, _ := limiter.allow_client(req); !ok {
+		log.Println("rate limited", name, client_ip(req))
+		return
+	}
+	forward_headers(req)
+	token, ws_ch := tunnels.add()
+	defer tunnels.cancel(token, ws_ch)
+	req.Header.Set(webswitch.HEADER_TUNNEL, token)
+
+	ch := make(chan *PlugResponse)
+	hub.req_queue <- &ClientRequest{req, ch, ""}
+	pr, ok := <-ch
+	if !ok {
+		log.Println("error tunnel", name, "no response")
+		return
+	}
+	code := pr.Resp.StatusCode
+	pr.Close()
+	if code != http.StatusOK {
+		log.Println("error tunnel", name, "status", code)
+		return
+	}
+	select {
+	case ws := <-ws_ch:
+		log.Println("tunnel", name, "for", c.RemoteAddr())
+		if err := webswitch.Tunnel(ws, c); err != nil {
+			log.Println("error tunnel", name, err)
+		}
+		log.Println("tunnel", name, "closed for", c.RemoteAddr())
+	case <-time.After(TUNNEL_DIAL_TIMEOUT):
+		log.Println("error tunnel", name, "not connected back")
+	}
+}
+
+// Websocket handler for plugs connecting tunnels back
+func handleTunnel(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(webswitch.HEADER_TUNNEL)
+	if !tunnels.waits(token) {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("error upgrade tunnel:", err)
+		return
+	}
+	// too late, the visitor has given up
+	if !tunnels.give(token, ws) {
+		ws.Close()
+	}
+}
+
+// whether the vhost is a tunneled service, not for HTTP visitors
+func (cfg *HubConfig) tunneled(vhost string) bool {
+	_, ok := cfg.Tunnels[strings.ToLower(vhost)]
+	return ok
+}
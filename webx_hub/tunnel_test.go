@@ -0,0 +1,66 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_hub
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/yf13/webswitch"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_tunnel_table(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleTunnel))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	dialer := &websocket.Dialer{Subprotocols: []string{webswitch.SUB_PROTOCOL_WEBX}}
+
+	// unknown tokens are refused
+	if _, rsp, err := dialer.Dial(url, http.Header{webswitch.HEADER_TUNNEL: {"bogus"}}); err == nil ||
+		rsp.StatusCode != http.StatusNotFound {
+		t.Error("expected 404, got", err)
+	}
+	// the waiting tunnel gets the websocket once
+	token, ch := tunnels.add()
+	ws, _, err := dialer.Dial(url, http.Header{webswitch.HEADER_TUNNEL: {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if hub_ws := <-ch; hub_ws == nil {
+		t.Error("expected websocket of the tunnel")
+	} else {
+		hub_ws.Close()
+	}
+	if tunnels.take(token) != nil {
+		t.Error("expected token taken")
+	}
+	// a tunnel connecting back as the visitor gives up is closed
+	token, ch = tunnels.add()
+	late, _, err := dialer.Dial(url, http.Header{webswitch.HEADER_TUNNEL: {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	tunnels.cancel(token, ch)
+	late.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = late.ReadMessage(); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Error("expected closed tunnel, got", err)
+	}
+}
+
+func Test_tunnel_config(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hub.json")
+	ioutil.WriteFile(file, []byte(`{"Tunnels": {"SSH": ":2222"}}`), 0600)
+	cfg, err := LoadConfig(file)
+	if err != nil || !cfg.tunneled("ssh") || cfg.tunneled("www.test") {
+		t.Error("expected ssh tunneled, got", err, cfg)
+	}
+}
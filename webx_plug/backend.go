@@ -0,0 +1,253 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// scheme of real hosts listening on Unix sockets, e.g. "unix:///run/app.sock"
+const SCHEME_UNIX = "unix"
+
+// defaults of connections to real hosts
+const (
+	BACKEND_DIAL_SECS   = 10  // time to connect
+	BACKEND_TLS_SECS    = 10  // time of TLS handshakes
+	BACKEND_HEADER_SECS = 120 // time to wait response headers
+	BACKEND_IDLE_SECS   = 90  // time to keep idle connections
+	BACKEND_MAX_IDLE    = 16  // idle connections kept
+
+	BACKEND_RETRY_WAIT = 100 * time.Millisecond // wait before the first retry, doubled after
+)
+
+// BackendTransport tunes connections to the real host of a site,
+// zero values take the BACKEND_* defaults
+type BackendTransport struct {
+	DialSecs   int // time to connect
+	TLSSecs    int // time of TLS handshakes
+	HeaderSecs int // time to wait response headers once the request is sent
+	IdleSecs   int // time to keep idle connections
+	MaxConns   int // connections at most, unlimited if 0
+	MaxIdle    int // idle connections kept
+	// a new connection for each request
+	NoKeepAlive bool
+	// stay with HTTP/1.1 even if an "https" real host offers HTTP/2
+	NoHTTP2 bool
+	// times to resend idempotent requests without body that failed to
+	// reach the real host
+	Retries int
+}
+
+// seconds or the default
+func secs(n, def int) time.Duration {
+	if n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// backend is the real host of a site, with its own connection pool
+type backend struct {
+	scheme string // scheme of requests, empty to keep the one of the hub
+	host   string
+	client *http.Client
+}
+
+// prepare the backend of the vhost at the real host srv, as set by the
+// site config if any
+func new_backend(vhost, srv string, sc *SiteConfig) (*backend, error) {
+	u, err := url.Parse(srv)
+	if err != nil {
+		return nil, err
+	}
+	be := &backend{scheme: u.Scheme, host: u.Host}
+	if be.host == "" {
+		be.host = srv
+	}
+	bt := &BackendTransport{}
+	var tc *tls.Config
+	if sc != nil {
+		if sc.Transport != nil {
+			bt = sc.Transport
+		}
+		tc = sc.tls
+	}
+	if tc != nil && tc.InsecureSkipVerify {
+		log.Println("warn: real host of", vhost, "not verified")
+	}
+	dialer := &net.Dialer{Timeout: secs(bt.DialSecs, BACKEND_DIAL_SECS)}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tc,
+		TLSHandshakeTimeout:   secs(bt.TLSSecs, BACKEND_TLS_SECS),
+		ResponseHeaderTimeout: secs(bt.HeaderSecs, BACKEND_HEADER_SECS),
+		IdleConnTimeout:       secs(bt.IdleSecs, BACKEND_IDLE_SECS),
+		MaxConnsPerHost:       bt.MaxConns,
+		MaxIdleConnsPerHost:   bt.MaxIdle,
+		DisableKeepAlives:     bt.NoKeepAlive,
+		Protocols:             &http.Protocols{},
+	}
+	if tr.MaxIdleConnsPerHost <= 0 {
+		tr.MaxIdleConnsPerHost = BACKEND_MAX_IDLE
+	}
+	var rt http.RoundTripper = tr
+	switch be.scheme {
+	case SCHEME_H2C:
+		// HTTP/2 without TLS, no upgrade from HTTP/1.1
+		be.scheme = "http"
+		tr.Proxy = nil
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	case SCHEME_UNIX:
+		// HTTP/1.1 on the socket whatever the host of requests
+		be.scheme, be.host = "http", "localhost"
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.Path)
+		}
+		tr.Protocols.SetHTTP1(true)
+	case SCHEME_FCGI, SCHEME_FCGI_UNIX:
+		ft := &fcgiTransport{network: "tcp", addr: u.Host, cfg: &FastCGIConfig{},
+			dialer: dialer, header: tr.ResponseHeaderTimeout}
+		if be.scheme == SCHEME_FCGI_UNIX {
+			ft.network, ft.addr = "unix", u.Path
+		}
+		if sc != nil && sc.FastCGI != nil {
+			ft.cfg = sc.FastCGI
+		}
+		be.scheme, be.host = "http", "localhost"
+		rt = ft
+	case SCHEME_FILE:
+		var cfg *StaticConfig
+		if sc != nil {
+			cfg = sc.Static
+		}
+		site, err := new_static(u.Path, cfg)
+		if err != nil {
+			return nil, err
+		}
+		be.scheme, be.host = "http", "localhost"
+		rt = &handlerTransport{site}
+	default:
+		tr.Protocols.SetHTTP1(true)
+		tr.Protocols.SetHTTP2(!bt.NoHTTP2)
+	}
+	be.client = &http.Client{Transport: rt,
+		// redirects are for visitors to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	return be, nil
+}
+
+// send the request to the real host
+func (be *backend) do(req *http.Request) (*http.Response, error) {
+	if be.scheme != "" {
+		req.URL.Scheme = be.scheme
+	}
+	req.URL.Host = be.host
+	// need clear RequestURI in client requests.
+	req.RequestURI = ""
+	return be.client.Do(req)
+}
+
+// whether the failed request can be sent again: idempotent, without a
+// body that is consumed already and not timed out, so the real host
+// likely never saw it
+func retriable(req *http.Request, err error) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && !oe.Timeout()
+}
+
+// status of responses to requests failed at the real host
+func backend_status(err error) int {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// handlerTransport answers requests with a handler of the plug, the
+// response body streams from the handler as it writes
+type handlerTransport struct {
+	h http.Handler
+}
+
+// pipeWriter is the response writer of handlers run by handlerTransport
+type pipeWriter struct {
+	req    *http.Request
+	header http.Header
+	pw     *io.PipeWriter
+	pr     *io.PipeReader
+	rsp_ch chan *http.Response
+	wrote  bool
+}
+
+func (pw *pipeWriter) Header() http.Header {
+	return pw.header
+}
+
+func (pw *pipeWriter) WriteHeader(code int) {
+	if pw.wrote {
+		return
+	}
+	pw.wrote = true
+	rsp := &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        pw.header.Clone(),
+		ContentLength: -1,
+		Body:          pw.pr,
+		Request:       pw.req,
+	}
+	if n, err := strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		rsp.ContentLength = n
+	}
+	if pw.req.Method == "HEAD" {
+		rsp.Body = http.NoBody
+	}
+	pw.rsp_ch <- rsp
+}
+
+func (pw *pipeWriter) Write(p []byte) (int, error) {
+	pw.WriteHeader(http.StatusOK)
+	if pw.req.Method == "HEAD" {
+		return len(p), nil
+	}
+	return pw.pw.Write(p)
+}
+
+func (ht *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr, w := io.Pipe()
+	pw := &pipeWriter{req: req, header: http.Header{}, pw: w, pr: pr,
+		rsp_ch: make(chan *http.Response, 1)}
+	go func() {
+		defer w.Close()
+		ht.h.ServeHTTP(pw, req)
+		pw.WriteHeader(http.StatusOK)
+	}()
+	return <-pw.rsp_ch, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_backend(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(2 * time.Second)
+		}
+		w.Write([]byte(r.Proto))
+	}))
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	for scheme, proto := range map[string]string{"http": "HTTP/1.1", SCHEME_H2C: "HTTP/2.0"} {
+		be, err := new_pool("www.test", scheme+"://"+addr,
+			&SiteConfig{Transport: &BackendTransport{HeaderSecs: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := be.do(httptest.NewRequest("GET", "http://www.test/", nil), "1")
+		if err != nil || rsp.Proto != proto {
+			t.Fatal(scheme, "expected", proto, "got", rsp, err)
+		}
+		rsp.Body.Close()
+		if _, err = be.do(httptest.NewRequest("GET", "http://www.test/slow", nil), "2"); backend_status(err) != http.StatusGatewayTimeout {
+			t.Error(scheme, "expected timeout, got", err)
+		}
+	}
+
+	// nothing listens on a closed port
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	be, _ := new_pool("www.test", "http://"+l.Addr().String(),
+		&SiteConfig{Transport: &BackendTransport{Retries: 2}})
+	start := time.Now()
+	_, err := be.do(httptest.NewRequest("GET", "http://www.test/", nil), "3")
+	if err == nil || time.Since(start) < 3*BACKEND_RETRY_WAIT {
+		t.Error("expected 2 retries, got", err, time.Since(start))
+	}
+	start = time.Now()
+	be.do(httptest.NewRequest("POST", "http://www.test/", strings.NewReader("x")), "4")
+	if time.Since(start) >= BACKEND_RETRY_WAIT {
+		t.Error("expected no retries of posts")
+	}
+}
+
+func Test_backend_sockets(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"]+"|"+env["PATH_TRANSLATED"])
+		if r.URL.Path == "/missing.php" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Host + " " + string(body)))
+	})
+	dir := t.TempDir()
+	for _, srv := range []string{"unix://" + dir + "/App.sock", "fcgi+unix://" + dir + "/fpm.sock", "fcgi://"} {
+		var l net.Listener
+		var err error
+		if srv == "fcgi://" {
+			l, err = net.Listen("tcp", "127.0.0.1:0")
+			srv += l.Addr().String()
+		} else {
+			l, err = net.Listen("unix", srv[strings.Index(srv, "://")+3:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if strings.HasPrefix(srv, SCHEME_UNIX) {
+			go http.Serve(l, h)
+		} else {
+			go fcgi.Serve(l, h)
+		}
+		be, err := new_pool("www.test", srv,
+			&SiteConfig{FastCGI: &FastCGIConfig{Root: "/var/www"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct{ path, script string }{
+			{"/app/index.php/users/1?x=1", "/var/www/app/index.php|/var/www/users/1"},
+			{"/app/", "/var/www/app/index.php|"},
+			{"/missing.php", "/var/www/missing.php|"},
+		} {
+			rsp, err := be.do(httptest.NewRequest("POST", "http://www.test"+c.path,
+				strings.NewReader("data")), "1")
+			if err != nil {
+				t.Fatal(srv, err)
+			}
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			if string(body) != "www.test data" {
+				t.Error(srv, "bad body", string(body))
+			}
+			if srv[0] == 'f' && (rsp.Header.Get("X-Script") != c.script ||
+				(c.path == "/missing.php") != (rsp.StatusCode == http.StatusNotFound)) {
+				t.Error(srv, c.path, "got", rsp.StatusCode, rsp.Header.Get("X-Script"))
+			}
+		}
+		if srv[0] != 'f' {
+			continue
+		}
+		// bodies of unknown length are buffered up to a limit
+		for max, want := range map[int64]int{0: http.StatusOK, 2: http.StatusLengthRequired} {
+			be, _ := new_pool("www.test", srv,
+				&SiteConfig{FastCGI: &FastCGIConfig{Root: "/var/www", BodyBytes: max}})
+			r := httptest.NewRequest("POST", "http://www.test/", strings.NewReader("data"))
+			r.ContentLength = -1
+			rsp, err := be.do(r, "2")
+			if err != nil {
+				t.Fatal(srv, err)
+			}
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			if rsp.StatusCode != want || (want == http.StatusOK && string(body) != "www.test data") {
+				t.Error(srv, max, "chunked got", rsp.StatusCode, string(body))
+			}
+		}
+	}
+}
+
+func Test_fcgi_close(t *testing.T) {
+	// a script still printing when the response is dropped
+	pr, pw := io.Pipe()
+	c, peer := net.Pipe()
+	defer peer.Close()
+	done := make(chan error, 1)
+	go func() {
+		io.WriteString(pw, "Content-Type: text/plain\r\n\r\n")
+		_, err := io.WriteString(pw, "body")
+		done <- err
+	}()
+	rsp, err := fcgi_response(httptest.NewRequest("GET", "http://www.test/", nil), pr, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("expected write error after close")
+		}
+	case <-time.After(time.Second):
+		t.Error("stdout routine blocked after close")
+	}
+}
+
+func Test_backend_static(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "Docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "Docs", "index.html"), []byte("<h1>docs</h1>"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.js.gz"), []byte("gzipped"), 0644)
+	os.WriteFile(filepath.Join(dir, ".secret"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "javascript:alert(1)"), []byte("x"), 0644)
+	be, err := new_pool("www.test", "file://"+dir,
+		&SiteConfig{Static: &StaticConfig{List: true, Precompressed: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, kv ...string) (*http.Response, string) {
+		r := httptest.NewRequest("GET", "http://www.test"+path, nil)
+		for i := 0; i+1 < len(kv); i += 2 {
+			r.Header.Set(kv[i], kv[i+1])
+		}
+		rsp, err := be.do(r, "1")
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return rsp, string(body)
+	}
+	if rsp, body := get("/Docs/"); rsp.StatusCode != 200 || body != "<h1>docs</h1>" {
+		t.Error("expected index, got", rsp.StatusCode, body)
+	}
+	if rsp, _ := get("/Docs?a=1"); rsp.StatusCode != http.StatusMovedPermanently ||
+		rsp.Header.Get("Location") != "/Docs/?a=1" {
+		t.Error("expected redirect, got", rsp.StatusCode, rsp.Header)
+	}
+	if rsp, body := get("/"); rsp.StatusCode != 200 || !strings.Contains(body, `<a href="./Docs/">`) ||
+		!strings.Contains(body, `<a href="./javascript:alert%281%29">`) || strings.Contains(body, ".secret") {
+		t.Error("expected listing, got", rsp.StatusCode, body)
+	}
+	rsp, body := get("/app.js", "Accept-Encoding", "gzip, br")
+	if body != "gzipped" || rsp.Header.Get("Content-Encoding") != "gzip" ||
+		!strings.HasPrefix(rsp.Header.Get("Content-Type"), "text/javascript") {
+		t.Error("expected gzip variant, got", rsp.Header, body)
+	}
+	etag := rsp.Header.Get("ETag")
+	if rsp, _ = get("/app.js", "Accept-Encoding", "gzip", "If-None-Match", etag); rsp.StatusCode != http.StatusNotModified {
+		t.Error("expected 304, got", rsp.StatusCode)
+	}
+	if rsp, body = get("/app.js", "Range", "bytes=0-6"); rsp.StatusCode != http.StatusPartialContent ||
+		body != "console" {
+		t.Error("expected range, got", rsp.StatusCode, body)
+	}
+	for _, path := range []string{"/.secret", "/missing", "/../" + filepath.Base(dir) + "/app.js"} {
+		if rsp, _ = get(path); rsp.StatusCode != http.StatusNotFound {
+			t.Error(path, "expected 404, got", rsp.StatusCode)
+		}
+	}
+}
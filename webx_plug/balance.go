@@ -0,0 +1,294 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// balancing policies among real hosts of a site
+const (
+	BALANCE_ROUND_ROBIN = "round_robin" // in turn
+	BALANCE_LEAST_CONN  = "least_conn"  // fewest requests in progress for the weight
+	BALANCE_WEIGHTED    = "weighted"    // in turn, as often as the weight
+)
+
+// defaults of failure detection
+const (
+	BALANCE_MAX_FAILS = 3  // failures in a row ejecting a real host
+	BALANCE_FAIL_SECS = 30 // time an ejected real host is left out
+)
+
+// separator of real hosts of a site in -rhosts
+const RHOST_SEP = "|"
+
+// the real host URL as pools know it. host names are not case
+// sensitive, socket and directory paths are.
+func normal_rhost(r string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(r))
+	if err != nil {
+		return "", err
+	}
+	u.Host = strings.ToLower(u.Host)
+	return u.String(), nil
+}
+
+// BalanceConfig holds how requests of a site are spread over its real
+// hosts, given as "http://a:8080|http://b:8080" in -rhosts
+type BalanceConfig struct {
+	Policy   string         // one of BALANCE_*, round robin if empty
+	Weights  map[string]int // real host of -rhosts -> weight, 1 if missing
+	MaxFails int            // failures in a row ejecting a real host, BALANCE_MAX_FAILS if 0
+	FailSecs int            // time an ejected real host is left out, BALANCE_FAIL_SECS if 0
+}
+
+// member is a real host of a pool, counters are guarded by the pool
+type member struct {
+	*backend
+	url       string
+	weight    int
+	active    int       // requests in progress
+	requests  int64     // requests sent
+	failures  int64     // requests failed
+	ejections int64     // times ejected
+	fails     int       // failures in a row
+	ejected   time.Time // left out until then
+	current   int       // running weight of the weighted policy
+}
+
+// pool is the set of real hosts of a site
+type pool struct {
+	sync.Mutex
+	vhost     string
+	policy    string
+	members   []*member
+	next      int // turn of round robin policies
+	max_fails int
+	fail_time time.Duration
+	retries   int
+}
+
+// prepare the pool of the vhost for the real hosts srvs, separated
+// by RHOST_SEP, as set by the site config if any
+func new_pool(vhost, srvs string, sc *SiteConfig) (*pool, error) {
+	p := &pool{vhost: vhost, policy: BALANCE_ROUND_ROBIN}
+	bc := &BalanceConfig{}
+	if sc != nil && sc.Balance != nil {
+		bc = sc.Balance
+	}
+	if sc != nil && sc.Transport != nil {
+		p.retries = sc.Transport.Retries
+	}
+	if p.retries < 0 {
+		return nil, errors.New(vhost + ": negative retries")
+	}
+	switch strings.ToLower(bc.Policy) {
+	case "", BALANCE_ROUND_ROBIN:
+	case BALANCE_LEAST_CONN, BALANCE_WEIGHTED:
+		p.policy = strings.ToLower(bc.Policy)
+	default:
+		return nil, errors.New(vhost + ": bad balance policy " + bc.Policy)
+	}
+	p.max_fails = bc.MaxFails
+	if p.max_fails <= 0 {
+		p.max_fails = BALANCE_MAX_FAILS
+	}
+	p.fail_time = secs(bc.FailSecs, BALANCE_FAIL_SECS)
+	// weights by real hosts as the members have them
+	weights := make(map[string]int, len(bc.Weights))
+	for r, w := range bc.Weights {
+		srv, err := normal_rhost(r)
+		if err != nil {
+			return nil, errors.New(vhost + ": bad weight of " + r + ": " + err.Error())
+		}
+		if w <= 0 {
+			return nil, errors.New(vhost + ": bad weight of " + r)
+		}
+		weights[srv] = w
+	}
+	for _, srv := range strings.Split(srvs, RHOST_SEP) {
+		be, err := new_backend(vhost, srv, sc)
+		if err != nil {
+			return nil, err
+		}
+		m := &member{backend: be, url: srv, weight: 1}
+		if w, ok := weights[srv]; ok {
+			m.weight = w
+		}
+		p.members = append(p.members, m)
+	}
+	// a weight of no member is a typo, not to be ignored
+	for srv := range weights {
+		found := false
+		for _, m := range p.members {
+			found = found || m.url == srv
+		}
+		if !found {
+			return nil, errors.New(vhost + ": weight of unknown real host " + srv)
+		}
+	}
+	return p, nil
+}
+
+// pick a real host for a request, other than avoid if possible
+func (p *pool) pick(avoid *member) *member {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	var ms []*member
+	for _, m := range p.members {
+		if m != avoid && now.After(m.ejected) {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 && avoid != nil && now.After(avoid.ejected) {
+		ms = []*member{avoid}
+	}
+	if len(ms) == 0 {
+		// all ejected, better try them than fail
+		ms = p.members
+	}
+	var m *member
+	switch p.policy {
+	case BALANCE_WEIGHTED:
+		// smooth weighted round robin
+		total := 0
+		for _, c := range ms {
+			c.current += c.weight
+			total += c.weight
+			if m == nil || c.current > m.current {
+				m = c
+			}
+		}
+		m.current -= total
+	case BALANCE_LEAST_CONN:
+		for i := range ms {
+			c := ms[(p.next+i)%len(ms)]
+			if m == nil || c.active*m.weight < m.active*c.weight {
+				m = c
+			}
+		}
+		p.next++
+	default:
+		m = ms[p.next%len(ms)]
+		p.next++
+	}
+	m.active++
+	m.requests++
+	return m
+}
+
+// account the outcome of a request to the real host
+func (p *pool) done(m *member, err error) {
+	p.Lock()
+	defer p.Unlock()
+	m.active--
+	if err == nil {
+		m.fails = 0
+		return
+	}
+	m.failures++
+	m.fails++
+	if m.fails >= p.max_fails && len(p.members) > 1 {
+		m.fails = 0
+		m.ejections++
+		m.ejected = time.Now().Add(p.fail_time)
+		log.Printf("ejected %s of %s for %v", m.url, p.vhost, p.fail_time)
+	}
+}
+
+// response body telling the pool when the request is over
+type poolBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *poolBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// send the request to a real host of the pool, resending it to another
+// one on failures to connect as far as allowed
+func (p *pool) do(req *http.Request, reqId string) (*http.Response, error) {
+	wait := BACKEND_RETRY_WAIT
+	var m *member
+	for i := 0; ; i++ {
+		m = p.pick(m)
+		if len(p.members) > 1 {
+			log.Printf("req#%s to %s", reqId, m.url)
+		}
+		rsp, err := m.do(req)
+		if err != nil {
+			p.done(m, err)
+		} else if rsp.Body == nil || rsp.Body == http.NoBody {
+			p.done(m, nil)
+		} else {
+			picked := m
+			rsp.Body = &poolBody{ReadCloser: rsp.Body, done: func() { p.done(picked, nil) }}
+		}
+		if err == nil || i >= p.retries || !retriable(req, err) {
+			return rsp, err
+		}
+		log.Printf("retry req#%s after %v: %v", reqId, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// BackendStatus tells the state of a real host of a site
+type BackendStatus struct {
+	Url         string
+	Weight      int
+	Active      int   // requests in progress
+	Requests    int64 // requests sent
+	Failures    int64 // requests failed
+	Ejections   int64 // times ejected
+	EjectedSecs int   // time left out, 0 if in use
+}
+
+// PoolStatus tells the state of the real hosts of a site
+type PoolStatus struct {
+	Policy   string
+	Backends []BackendStatus
+}
+
+// snapshot of the pool state
+func (p *pool) status() PoolStatus {
+	p.Lock()
+	defer p.Unlock()
+	ps := PoolStatus{Policy: p.policy}
+	for _, m := range p.members {
+		bs := BackendStatus{Url: m.url, Weight: m.weight, Active: m.active,
+			Requests: m.requests, Failures: m.failures, Ejections: m.ejections}
+		if left := time.Until(m.ejected); left > 0 {
+			bs.EjectedSecs = int(left/time.Second) + 1
+		}
+		ps.Backends = append(ps.Backends, bs)
+	}
+	return ps
+}
+
+// serve the state of the pools as JSON, by vhost
+func metrics_handler(pools map[string]*pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string]PoolStatus, len(pools))
+		for vhost, p := range pools {
+			status[vhost] = p.status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_balance_policies(t *testing.T) {
+	p, err := new_pool("www.test", "http://a|http://b", &SiteConfig{Balance: &BalanceConfig{
+		Policy: "Weighted", Weights: map[string]int{" HTTP://A": 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := ""
+	for i := 0; i < 8; i++ {
+		m := p.pick(nil)
+		p.done(m, nil)
+		seq += m.url[7:]
+	}
+	if seq != "aabaaaba" {
+		t.Error("bad weighted sequence", seq)
+	}
+
+	p.policy = BALANCE_LEAST_CONN
+	a, b := p.members[0], p.members[1]
+	a.active, b.active = 7, 2
+	if m := p.pick(nil); m != b {
+		t.Error("expected b with fewer requests for its weight")
+	}
+	a.active = 3
+	if m := p.pick(nil); m != a {
+		t.Error("expected a by weight, got", m.url)
+	}
+
+	for _, bad := range []*BalanceConfig{{Policy: "random"}, {Weights: map[string]int{"http://a": -1}},
+		{Weights: map[string]int{"http://c": 2}}} {
+		if _, err := new_pool("www.test", "http://a|http://b", &SiteConfig{Balance: bad}); err == nil {
+			t.Error("expected error for", *bad)
+		}
+	}
+}
+
+func Test_balance_ejection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	dead := "http://" + l.Addr().String()
+	p, err := new_pool("www.test", dead+"|"+srv.URL, &SiteConfig{Balance: &BalanceConfig{MaxFails: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() error {
+		rsp, err := p.do(httptest.NewRequest("GET", "http://www.test/", nil), "1")
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+	fails := 0
+	for i := 0; i < 10; i++ {
+		if get() != nil {
+			fails++
+		}
+	}
+	st := p.status()
+	if fails != 2 || st.Backends[0].Ejections != 1 || st.Backends[0].EjectedSecs == 0 ||
+		st.Backends[1].Requests != 8 || st.Backends[1].Active != 0 {
+		t.Error("expected dead host ejected after 2 failures, got", fails, st)
+	}
+
+	// retried on the other host
+	p.members[0].ejected = p.members[0].ejected.AddDate(-1, 0, 0)
+	p.retries = 1
+	for i := 0; i < 4; i++ {
+		if err := get(); err != nil {
+			t.Error("expected retry on live host, got", err)
+		}
+	}
+	w := httptest.NewRecorder()
+	metrics_handler(map[string]*pool{"www.test": p})(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `"Policy":"round_robin"`) {
+		t.Error("bad metrics", w.Body)
+	}
+}
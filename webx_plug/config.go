@@ -0,0 +1,99 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/yf13/webswitch"
+	"io/ioutil"
+	"strings"
+)
+
+// SiteConfig holds settings of one published site
+type SiteConfig struct {
+	// headers passing the visitor identity asserted by the hub to the
+	// real host, as header name -> value template where "{user}" is the
+	// visitor, e.g. {"X-Remote-User": "{user}"}. These headers are always
+	// dropped from incoming requests, so visitors can't fake them.
+	Identity map[string]string
+	// rules for requests to the real host and responses from it
+	Headers *webswitch.HeaderRules
+	// TLS settings to reach an "https" real host
+	TLS *BackendTLS
+	// timeouts, pool size and retries of requests to the real host
+	Transport *BackendTransport
+	// settings of a FastCGI real host
+	FastCGI *FastCGIConfig
+	// settings of a site served from a local directory
+	Static *StaticConfig
+	// balancing of requests over several real hosts
+	Balance *BalanceConfig
+
+	tls *tls.Config // built from TLS
+}
+
+// PlugConfig is the optional JSON config file of the plug (-config), e.g.
+//
+//	{
+//	  "IdentityKey": "secret shared with the hub",
+//	  "Sites": {
+//	    "wiki.example.com": {"Identity": {"X-Remote-User": "{user}"},
+//	      "Headers": {"Request": [{"Op": "set", "Name": "X-Forwarded-Prefix", "Value": "/wiki"}]}},
+//	    "erp.example.com": {"TLS": {"CA": "/etc/webx/intranet-ca.pem", "ServerName": "erp.corp",
+//	      "Cert": "/etc/webx/plug.crt", "Key": "/etc/webx/plug.key", "MinVersion": "1.2"},
+//	      "Transport": {"HeaderSecs": 30, "MaxConns": 64, "Retries": 2}},
+//	    "php.example.com": {"FastCGI": {"Root": "/var/www/html"}},
+//	    "docs.example.com": {"Static": {"List": true, "Precompressed": true}},
+//	    "shop.example.com": {"Balance": {"Policy": "least_conn",
+//	      "Weights": {"http://shop1:8080": 2, "http://shop2:8080": 1}}}
+//	  }
+//	}
+type PlugConfig struct {
+	// secret shared with the hub to verify visitor identities
+	IdentityKey string
+	// vhost -> settings
+	Sites map[string]*SiteConfig
+}
+
+// the plug config, empty unless -config is given
+var config = &PlugConfig{}
+
+// load plug config from JSON file
+func LoadConfig(file string) (*PlugConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &PlugConfig{}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	sites := make(map[string]*SiteConfig, len(cfg.Sites))
+	for vhost, sc := range cfg.Sites {
+		if sc == nil {
+			continue
+		}
+		if sc.Headers != nil {
+			if err = sc.Headers.Compile(); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+		}
+		if sc.TLS != nil {
+			if sc.tls, err = sc.TLS.config(); err != nil {
+				return nil, errors.New(vhost + ": " + err.Error())
+			}
+		}
+		sites[strings.ToLower(vhost)] = sc
+	}
+	cfg.Sites = sites
+	return cfg, nil
+}
+
+// settings of the site, nil if not configured
+func (cfg *PlugConfig) site(vhost string) *SiteConfig {
+	return cfg.Sites[strings.ToLower(vhost)]
+}
@@ -4,15 +4,27 @@
 
 /*
 
-This is the WebSwitch plug program.
+This is the WebSwitch plug, run by the "webx plug" command.
 
 This is a pure TCP client program that only makes outgoing TCP connections to the hub and
 published sites.
 
 Each plug connects to one hub and can publish multiple web sites.
 
-*/
-package main
+Real hosts are given as URLs like "http://localhost:8080". Those with the
+"h2c" scheme are reached with HTTP/2 without TLS, as most gRPC servers need.
+Those with the "tcp" scheme, like "tcp://localhost:22", are TCP services
+tunneled from hub ports, each tunnel over its own websocket to the hub.
+Those with the "unix" scheme, like "unix:///run/app.sock", listen on Unix
+sockets, and those with the "fcgi" or "fcgi+unix" scheme are FastCGI servers,
+like PHP-FPM pools, with document roots set in the config file. Those with
+the "file" scheme, like "file:///srv/docs", are local directories served by
+the plug itself. Several real hosts of a site, separated by "|", share its
+requests by a balancing policy, leaving out failing ones for a while.
+
+An optional JSON file given by "-config" holds per site settings, like the headers
+carrying visitor identities verified with the key shared with the hub, or TLS
+settings to reach "https" real hosts with private CAs or client certificates.
 
-// version number of this app
-const APP_VERSION = "0.1"
+*/
+package webx_plug
@@ -0,0 +1,365 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/yf13/webswitch"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemes of FastCGI real hosts, e.g. PHP-FPM pools as
+// "fcgi://localhost:9000" or "fcgi+unix:///run/php/fpm.sock"
+const (
+	SCHEME_FCGI      = "fcgi"
+	SCHEME_FCGI_UNIX = "fcgi+unix"
+)
+
+// FastCGI defaults
+const (
+	FCGI_INDEX      = "index.php" // script of directory paths
+	FCGI_SCRIPT_EXT = ".php"      // paths are split after this into script and PATH_INFO
+	FCGI_BODY_BYTES = 8 << 20     // largest body of unknown length to buffer
+)
+
+// FastCGIConfig holds settings of FastCGI real hosts
+type FastCGIConfig struct {
+	Root  string // document root on the FastCGI server, e.g. "/var/www/html"
+	Index string // script of directory paths, FCGI_INDEX if empty
+	// largest body of unknown length, like chunked uploads, to buffer as
+	// CONTENT_LENGTH is needed, FCGI_BODY_BYTES if 0. larger ones get 411
+	BodyBytes int64
+	// params to add or override, e.g. {"SCRIPT_FILENAME": "/srv/app/index.php"}
+	// to send every request to a front controller
+	Params map[string]string
+}
+
+// FastCGI record types and roles used here
+const (
+	fcgi_version       = 1
+	fcgi_begin_request = 1
+	fcgi_end_request   = 3
+	fcgi_params        = 4
+	fcgi_stdin         = 5
+	fcgi_stdout        = 6
+	fcgi_stderr        = 7
+	fcgi_responder     = 1
+	fcgi_max_content   = 65535
+	fcgi_request_id    = 1 // one request per connection
+)
+
+// fcgiTransport sends requests to a FastCGI responder, one connection each
+type fcgiTransport struct {
+	network string // "tcp" or "unix"
+	addr    string
+	cfg     *FastCGIConfig
+	dialer  *net.Dialer
+	header  time.Duration // time to wait response headers
+}
+
+// write one record
+func fcgi_write(w io.Writer, typ uint8, content []byte) error {
+	pad := -len(content) & 7
+	rec := make([]byte, 8, 8+len(content)+pad)
+	rec[0], rec[1] = fcgi_version, typ
+	binary.BigEndian.PutUint16(rec[2:], fcgi_request_id)
+	binary.BigEndian.PutUint16(rec[4:], uint16(len(content)))
+	rec[6] = uint8(pad)
+	rec = append(rec, content...)
+	rec = append(rec, make([]byte, pad)...)
+	_, err := w.Write(rec)
+	return err
+}
+
+// write a stream of records ended by an empty one
+func fcgi_write_stream(w io.Writer, typ uint8, r io.Reader) error {
+	if r != nil {
+		buf := make([]byte, fcgi_max_content)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if werr := fcgi_write(w, typ, buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return fcgi_write(w, typ, nil)
+}
+
+// encode a length of name-value pairs
+func fcgi_len(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, uint8(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+// encode params as name-value pairs
+func fcgi_pairs(params map[string]string) []byte {
+	var b []byte
+	for k, v := range params {
+		b = fcgi_len(fcgi_len(b, len(k)), len(v))
+		b = append(append(b, k...), v...)
+	}
+	return b
+}
+
+// split the path into script and extra path info
+func (cfg *FastCGIConfig) split(p string) (string, string) {
+	if i := strings.Index(p, FCGI_SCRIPT_EXT+"/"); i >= 0 {
+		return p[:i+len(FCGI_SCRIPT_EXT)], p[i+len(FCGI_SCRIPT_EXT):]
+	}
+	if strings.HasSuffix(p, "/") {
+		index := cfg.Index
+		if index == "" {
+			index = FCGI_INDEX
+		}
+		return p + index, ""
+	}
+	return p, ""
+}
+
+// CGI params of the request
+func (cfg *FastCGIConfig) params(req *http.Request) map[string]string {
+	clean := path.Clean("/" + req.URL.Path)
+	if strings.HasSuffix(req.URL.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	script, info := cfg.split(clean)
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+	}
+	p := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "webx/" + webswitch.APP_VERSION,
+		"SERVER_PROTOCOL":   req.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     cfg.Root,
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   path.Join(cfg.Root, script),
+		"PATH_INFO":         info,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+	}
+	if info != "" {
+		p["PATH_TRANSLATED"] = path.Join(cfg.Root, info)
+	}
+	if req.ContentLength >= 0 {
+		p["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	// the visitor as the hub saw it
+	if ff := req.Header.Get(webswitch.HEADER_FORWARD_FOR); ff != "" {
+		ips := strings.Split(ff, ",")
+		p["REMOTE_ADDR"] = strings.TrimSpace(ips[len(ips)-1])
+	}
+	if strings.EqualFold(req.Header.Get(webswitch.HEADER_FORWARD_PROTO), "https") {
+		p["HTTPS"] = "on"
+		if port == "80" && !strings.Contains(req.Host, ":") {
+			p["SERVER_PORT"] = "443"
+		}
+	}
+	for k, vv := range req.Header {
+		switch k {
+		// Proxy is left out against httpoxy
+		case "Content-Type", "Content-Length", "Proxy":
+			continue
+		}
+		p["HTTP_"+strings.ToUpper(strings.ReplaceAll(k, "-", "_"))] = strings.Join(vv, ", ")
+	}
+	p["HTTP_HOST"] = req.Host
+	for k, v := range cfg.Params {
+		p[k] = v
+	}
+	return p
+}
+
+// body of FastCGI responses, closing it drops the connection and stops
+// the routine passing stdout records on
+type fcgiBody struct {
+	io.Reader
+	c  net.Conn
+	pr *io.PipeReader
+}
+
+func (b *fcgiBody) Close() error {
+	b.pr.CloseWithError(net.ErrClosed)
+	return b.c.Close()
+}
+
+// buffer the body of unknown length, which FastCGI servers like PHP-FPM
+// drop without CONTENT_LENGTH. returns false if it is too large.
+func (cfg *FastCGIConfig) buffer(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength >= 0 {
+		return req, true
+	}
+	max := cfg.BodyBytes
+	if max <= 0 {
+		max = FCGI_BODY_BYTES
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil || int64(len(body)) > max {
+		return req, false
+	}
+	r := *req
+	r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	return &r, true
+}
+
+func (ft *fcgiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, ok := ft.cfg.buffer(req)
+	if !ok {
+		code := http.StatusLengthRequired
+		return &http.Response{
+			Status:     strconv.Itoa(code) + " " + http.StatusText(code),
+			StatusCode: code,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	c, err := ft.dialer.DialContext(req.Context(), ft.network, ft.addr)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(ft.header))
+
+	// send the request while reading the response
+	go func() {
+		var begin [8]byte
+		begin[1] = fcgi_responder
+		err := fcgi_write(c, fcgi_begin_request, begin[:])
+		pairs := fcgi_pairs(ft.cfg.params(req))
+		for len(pairs) > 0 && err == nil {
+			n := len(pairs)
+			if n > fcgi_max_content {
+				n = fcgi_max_content
+			}
+			err = fcgi_write(c, fcgi_params, pairs[:n])
+			pairs = pairs[n:]
+		}
+		if err == nil {
+			err = fcgi_write(c, fcgi_params, nil)
+		}
+		if err == nil {
+			err = fcgi_write_stream(c, fcgi_stdin, req.Body)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	// pass stdout records on as the CGI response
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(c)
+		var hdr [8]byte
+		for {
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				pw.CloseWithError(err)
+				c.Close()
+				return
+			}
+			content := io.LimitReader(br, int64(binary.BigEndian.Uint16(hdr[4:])))
+			var err error
+			switch hdr[1] {
+			case fcgi_stdout:
+				_, err = io.Copy(pw, content)
+			case fcgi_stderr:
+				msg, _ := io.ReadAll(content)
+				log.Printf("fcgi %s: %s", ft.addr, strings.TrimSpace(string(msg)))
+			case fcgi_end_request:
+				pw.Close()
+				c.Close()
+				return
+			}
+			// skip the rest and the padding
+			if err == nil {
+				if _, err = io.Copy(io.Discard, content); err == nil {
+					_, err = br.Discard(int(hdr[6]))
+				}
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				c.Close()
+				return
+			}
+		}
+	}()
+	return fcgi_response(req, pr, c)
+}
+
+// read the CGI response of the script, its body is read on from pr
+func fcgi_response(req *http.Request, pr *io.PipeReader, c net.Conn) (*http.Response, error) {
+	br := bufio.NewReader(pr)
+	body := &fcgiBody{br, c, pr}
+	mh, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(mh) > 0) {
+		body.Close()
+		return nil, err
+	}
+	// headers are in, the body may take its time
+	c.SetReadDeadline(time.Time{})
+	h := http.Header(mh)
+	code := http.StatusOK
+	if status := h.Get("Status"); status != "" {
+		if code, err = strconv.Atoi(strings.Fields(status + " ")[0]); err != nil || code < 100 {
+			body.Close()
+			return nil, errors.New("bad fcgi status: " + status)
+		}
+		h.Del("Status")
+	} else if h.Get("Location") != "" {
+		code = http.StatusFound
+	}
+	rsp := &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		ContentLength: -1,
+		Body:          body,
+		Request:       req,
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		rsp.ContentLength = n
+	}
+	if req.Method == "HEAD" {
+		rsp.Body.Close()
+		rsp.Body = http.NoBody
+	}
+	return rsp, nil
+}
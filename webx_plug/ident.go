@@ -0,0 +1,36 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"github.com/yf13/webswitch"
+	"net/http"
+	"strings"
+)
+
+// replace the identity asserted by the hub with the headers the site
+// expects. Identity headers of the site are dropped in any case, and an
+// assertion failing verification is an error.
+func apply_identity(req *http.Request, reqId string) error {
+	value := req.Header.Get(webswitch.HEADER_IDENTITY)
+	req.Header.Del(webswitch.HEADER_IDENTITY)
+	site := config.site(req.Host)
+	if site != nil {
+		for h := range site.Identity {
+			req.Header.Del(h)
+		}
+	}
+	if value == "" || site == nil || len(site.Identity) == 0 {
+		return nil
+	}
+	user, err := webswitch.VerifyIdentity([]byte(config.IdentityKey), value, reqId)
+	if err != nil {
+		return err
+	}
+	for h, tmpl := range site.Identity {
+		req.Header.Set(h, strings.Replace(tmpl, "{user}", user, -1))
+	}
+	return nil
+}
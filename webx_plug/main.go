@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package webx_plug
 
 import (
 	"bufio"
@@ -11,12 +11,14 @@ import (
 	"flag"
 	"github.com/gorilla/websocket"
 	"github.com/yf13/webswitch"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,22 +28,26 @@ const (
 	HUB_RSP_QUEUE_LEN = 5
 )
 
-// command line options
+// command line options, parsed by Main
 var (
-	fe_url     = flag.String("hub", "", "hub's URL to plug into. (e.g. wss://hub:8443/_webx)")
-	limit      = flag.Int64("limit", 0, "size limit, 0 is unlimited.")
-	key_file   = flag.String("key", "", "plug private key.pem.")
-	cert_file  = flag.String("cert", "", "plug public signed cert.crt.")
-	ca_file    = flag.String("ca", "", "root CA pem: ca.crt")
-	retry_wait = flag.Int("retry", 60, "redial waiting seconds")
-	vhosts     = flag.String("hosts", "", "comma separated virtual hosts (e.g. 'ibm.com:8080,hp.com')")
-	rhosts     = flag.String("rhosts", "", "comma separated corresponding real hosts (e.g. 'http://localhost:8081,http://localhost:8082')")
+	flags      = flag.NewFlagSet("plug", flag.ExitOnError)
+	fe_url     = flags.String("hub", "", "hub's URL to plug into. (e.g. wss://hub:8443/_webx)")
+	limit      = flags.Int64("limit", 0, "size limit of request bodies, 0 is unlimited.")
+	key_file   = flags.String("key", "", "plug private key.pem.")
+	cert_file  = flags.String("cert", "", "plug public signed cert.crt.")
+	ca_file    = flags.String("ca", "", "root CA pem: ca.crt")
+	retry_wait = flags.Int("retry", 60, "redial waiting seconds")
+	vhosts     = flags.String("hosts", "", "comma separated virtual hosts (e.g. 'ibm.com:8080,hp.com')")
+	cfg_file   = flags.String("config", "", "plug config file (.json) for per site settings.")
+	deflate    = flags.Bool("deflate", true, "compress hub link messages with per-message deflate if the hub agrees.")
+	metrics    = flags.String("metrics", "", "address serving real host metrics as JSON at /metrics (e.g. 127.0.0.1:8083)")
+	rhosts     = flags.String("rhosts", "", "comma separated corresponding real hosts, '|' separated for balancing (e.g. 'http://localhost:8081,h2c://localhost:50051,tcp://localhost:22,unix:///run/app.sock,fcgi://localhost:9000,file:///srv/docs')")
 	//feLinks=flag.String("links", "0:1", "list of link limit(KB):number, ...")
 )
 
-// dial frontend switch hub with specified limit
-func dial_hub(feUrl string, limit int64) (*websocket.Conn, error) {
-	dialer := websocket.Dialer{} // take default options
+// dialer of websockets to the hub
+func hub_dialer() *websocket.Dialer {
+	dialer := &websocket.Dialer{} // take default options
 	caPool := x509.NewCertPool()
 	// load root ca if it is specified
 	if pem, err := ioutil.ReadFile(*ca_file); err == nil {
@@ -65,6 +71,14 @@ func dial_hub(feUrl string, limit int64) (*websocket.Conn, error) {
 		}
 	}
 	dialer.Subprotocols = []string{webswitch.SUB_PROTOCOL_WEBX}
+	dialer.EnableCompression = *deflate
+	return dialer
+}
+
+// dial frontend switch hub with specified limit.
+// returns the conn and whether the hub accepts streamed messages.
+func dial_hub(feUrl string, limit int64) (*websocket.Conn, bool, error) {
+	dialer := hub_dialer()
 	h := make(http.Header)
 	for _, v := range strings.Split(*vhosts, ",") {
 		h.Add(webswitch.HEADER_PROXY_FOR, v)
@@ -73,14 +87,18 @@ func dial_hub(feUrl string, limit int64) (*websocket.Conn, error) {
 		h.Add(webswitch.HEADER_MESSAGE_LIMIT,
 			strconv.FormatInt(limit, webswitch.MESSAGE_LIMIT_BASE))
 	}
+	h.Add(webswitch.HEADER_STREAM, "1")
 	log.Printf("dialing %s with limit=%d...", feUrl, limit)
-	c, _, err := dialer.Dial(feUrl, h)
+	c, rsp, err := dialer.Dial(feUrl, h)
+	stream := false
 	if err != nil {
 		log.Println("error dial:", err)
 	} else {
-		log.Println("connected")
+		stream = rsp.Header.Get(webswitch.HEADER_STREAM) != ""
+		log.Println("connected, stream:", stream, "deflate:", strings.Contains(
+			rsp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"))
 	}
-	return c, err
+	return c, stream, err
 }
 
 type HubRequest struct {
@@ -88,46 +106,92 @@ type HubRequest struct {
 	done chan bool
 }
 
+// request body telling the hub reader when it is consumed, so that
+// request bodies can keep streaming after response headers came back.
+type hubReqBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan<- bool
+}
+
+func (b *hubReqBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() { b.done <- true })
+	}
+	return n, err
+}
+
+func (b *hubReqBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done <- true })
+	return err
+}
+
 // hub request reader.
 // It reads incoming request from frontend hub and pass them
 // to the main loop via the ch. The ch should be closed when
 // reader ends
-func hubReader(conn *websocket.Conn, ch chan<- *HubRequest) {
+func hubReader(conn *websocket.Conn, stream bool, ch chan<- *HubRequest) {
 	// always ch before return
 	defer close(ch)
 
 	// reader loop
 	for {
-		mt, r, err := conn.NextReader()
-		if err != nil {
-			log.Println("error open hub reader:", err)
-			conn.Close()
-			return
-		}
-		if mt == websocket.BinaryMessage {
-			req, err := http.ReadRequest(bufio.NewReader(r))
+		var r io.Reader
+		var sr *webswitch.StreamReader
+		if stream {
+			sr = webswitch.NewStreamReader(conn)
+			r = sr
+		} else {
+			mt, mr, err := conn.NextReader()
 			if err != nil {
-				// log and ignore this error
-				log.Println("warn read hub req:", err)
+				log.Println("error open hub reader:", err)
+				conn.Close()
+				return
+			}
+			if mt != websocket.BinaryMessage {
+				log.Println("wrong hub req type:", mt)
 				continue
 			}
+			r = mr
+		}
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err == nil {
 			// forward the request to web client
-			done := make(chan bool)
+			done := make(chan bool, 1)
+			if req.Body == nil || req.Body == http.NoBody {
+				done <- true
+			} else {
+				req.Body = &hubReqBody{ReadCloser: req.Body, done: done}
+			}
 			ch <- &HubRequest{req, done}
-			// make sure client closed the req fully before
+			// make sure client consumed the req fully before
 			// reading next one.
 			<-done
-		} else {
-			log.Println("wrong hub req type:", mt)
+		} else if !stream {
+			// log and ignore this error
+			log.Println("warn read hub req:", err)
 			continue
 		}
+		// skip the rest of streamed request
+		if sr != nil {
+			if derr := sr.Drain(); derr != nil {
+				log.Println("error read hub:", derr)
+				conn.Close()
+				return
+			}
+			if err != nil {
+				log.Println("warn read hub req:", err)
+			}
+		}
 	}
 }
 
 // hub writer routine.
 // It forwards incoming http response to frontend hub.
 // it closes the underlying conn before exit
-func hubWriter(conn *websocket.Conn, ch <-chan *http.Response) {
+func hubWriter(conn *websocket.Conn, stream bool, ch <-chan *http.Response) {
 
 	// always close underlying conn
 	defer conn.Close()
@@ -142,6 +206,21 @@ func hubWriter(conn *websocket.Conn, ch <-chan *http.Response) {
 			break
 		}
 		if nil != rsp {
+			// skip compressing bodies that are compressed already
+			conn.EnableWriteCompression(webswitch.Compressible(rsp.Header))
+		}
+		if nil != rsp && stream {
+			// stream the response, its body is sent as it arrives
+			rspId := webswitch.ResponseId(rsp)
+			if err := webswitch.StreamResponse(conn, rsp); err != nil {
+				log.Println("error stream hub", err)
+			} else {
+				log.Printf("sent rsp#%s to hub", rspId)
+			}
+			if rsp.Body != nil {
+				rsp.Body.Close()
+			}
+		} else if nil != rsp {
 			// forward the response to frontend hub
 			w, err := conn.NextWriter(websocket.BinaryMessage)
 			if err != nil {
@@ -177,7 +256,7 @@ func hubWriter(conn *websocket.Conn, ch <-chan *http.Response) {
 func webClient(
 	id int,
 	req *HubRequest,
-	srv string,
+	p *pool,
 	rsp_ch chan<- *http.Response,
 	clt_done chan<- int,
 ) {
@@ -190,39 +269,64 @@ func webClient(
 		if reqId != "" {
 			log.Printf("rcvd %s req#%s\n", req.req.Method, reqId)
 
-			// TODO: avoid parsing everytime
-			srvUrl, _ := url.Parse(srv)
-			if "" != srvUrl.Scheme {
-				req.req.URL.Scheme = srvUrl.Scheme
-			}
-			if "" != srvUrl.Host {
-				req.req.URL.Host = srvUrl.Host
-			} else {
-				req.req.URL.Host = srv
+			// pass visitor identity as the site expects
+			if err := apply_identity(req.req, reqId); err != nil {
+				log.Printf("error identity req#%s: %v", reqId, err)
+				req.req.Body.Close()
+				rsp_ch <- webswitch.QuickResponse(http.StatusForbidden, req.req)
+				return
 			}
 
-			// need clear RequestURI in client requests.
-			req.req.RequestURI = ""
+			// rewrite headers by the site rules
+			sc := config.site(req.req.Host)
+			if sc != nil && sc.Headers != nil {
+				webswitch.ApplyHeaderRules(sc.Headers.Request, req.req.Header)
+			}
 
-			rsp, err := http.DefaultClient.Do(req.req)
-			req.done <- true
+			rsp, err := p.do(req.req, reqId)
 			if err != nil {
 				log.Printf("error do req#%s: %v", webswitch.RequestId(req.req), err)
-				rsp_ch <- webswitch.QuickResponse(http.StatusInternalServerError,
-					req.req)
+				rsp_ch <- webswitch.QuickResponse(backend_status(err), req.req)
 				log.Printf("sent error rsp#%s\n", reqId)
 			} else {
+				if sc != nil && sc.Headers != nil {
+					webswitch.ApplyHeaderRules(sc.Headers.Response, rsp.Header)
+				}
 				rsp.Header.Add(webswitch.HEADER_REQUEST_ID, reqId)
+				keep_trailers(rsp)
 				rsp_ch <- rsp
 				log.Printf("sent rsp#%s\n", reqId)
 			}
 		} else {
+			req.req.Body.Close()
 			rsp_ch <- webswitch.QuickResponse(http.StatusMethodNotAllowed, req.req)
 			log.Println("denied req w/o id")
 		}
 	}
 }
 
+// scheme of real hosts speaking HTTP/2 without TLS, e.g. gRPC servers
+const SCHEME_H2C = "h2c"
+
+// prepare the response so that its trailers survive the trip to the hub.
+// Responses of unknown length, like those of HTTP/2 backends, are sent
+// chunked as HTTP/1.1 since only chunked bodies can carry trailers.
+func keep_trailers(rsp *http.Response) {
+	rsp.Proto, rsp.ProtoMajor, rsp.ProtoMinor = "HTTP/1.1", 1, 1
+	if rsp.ContentLength >= 0 || rsp.StatusCode < 200 ||
+		rsp.StatusCode == http.StatusNoContent ||
+		rsp.StatusCode == http.StatusNotModified ||
+		(rsp.Request != nil && rsp.Request.Method == "HEAD") {
+		return
+	}
+	rsp.TransferEncoding = []string{"chunked"}
+	// trailers not announced in the header get filled in this map
+	// once the body is read through
+	if rsp.Trailer == nil {
+		rsp.Trailer = make(http.Header)
+	}
+}
+
 /*
 // analysis feLinks option and save results in links map
 // no longer needed since each plug only creates one link with the hub
@@ -253,13 +357,22 @@ func parseLinks(opt string) map[int]int {
 }
 */
 
-// main entrance
-func main() {
+// run the plug with command line args, like "webx plug -hub ..."
+func Main(args []string) {
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds | log.Ldate)
 
-	flag.Parse()
+	flags.Parse(args)
+
+	log.Println("version:", webswitch.APP_VERSION)
 
-	log.Println("version:", APP_VERSION)
+	if *cfg_file != "" {
+		cfg, err := LoadConfig(*cfg_file)
+		if err != nil {
+			log.Println("error config:", err)
+			return
+		}
+		config = cfg
+	}
 
 	// links := parseLinks(*feLinks)
 	// log.Println(*feLinks, "==>", links)
@@ -283,6 +396,7 @@ func main() {
 	}
 	// preparing hosts map for proxy use purposes
 	hosts := make(map[string]string)
+	pools := make(map[string]*pool)
 	for i, v := range vlist {
 		v = strings.Trim(v, " ")
 		if v != "" {
@@ -297,11 +411,25 @@ func main() {
 				if key == "" {
 					key = v
 				}
-				if _, err := url.Parse(rlist[i]); err != nil {
-					log.Println("invalid rhost", rlist[i])
-					return
+				var srvs []string
+				for _, r := range strings.Split(rlist[i], RHOST_SEP) {
+					srv, err := normal_rhost(r)
+					if err != nil {
+						log.Println("invalid rhost", r)
+						return
+					}
+					srvs = append(srvs, srv)
+				}
+				key, srv := strings.ToLower(key), strings.Join(srvs, RHOST_SEP)
+				hosts[key] = srv
+				if !strings.HasPrefix(srv, SCHEME_TCP+"://") {
+					p, err := new_pool(key, srv, config.site(key))
+					if err != nil {
+						log.Println("invalid rhost", rlist[i], err)
+						return
+					}
+					pools[key] = p
 				}
-				hosts[strings.ToLower(key)] = strings.ToLower(rlist[i])
 			}
 		}
 	}
@@ -312,6 +440,15 @@ func main() {
 		log.Println(hosts)
 	}
 
+	if *metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics_handler(pools))
+		go func() {
+			log.Println("metrics:", *metrics)
+			log.Println("error metrics:", http.ListenAndServe(*metrics, mux))
+		}()
+	}
+
 	// client id seed
 	clientId := 0
 
@@ -321,7 +458,7 @@ func main() {
 		// chan to learn clients ending
 		cltEndCh := make(chan int, HUB_RSP_QUEUE_LEN)
 		// connect to frontend
-		if c, err := dial_hub(*fe_url, *limit); err == nil {
+		if c, stream, err := dial_hub(*fe_url, *limit); err == nil {
 			// prepare chans for hub reader/writer,
 			// resources clean up assigment is:
 			// - hub reader shall close the hubReqCh
@@ -330,8 +467,8 @@ func main() {
 			// - hub writer should close the underlying conn
 			hubReqCh := make(chan *HubRequest, HUB_REQ_QUEUE_LEN)
 			hubRspCh := make(chan *http.Response, HUB_RSP_QUEUE_LEN)
-			go hubReader(c, hubReqCh)
-			go hubWriter(c, hubRspCh)
+			go hubReader(c, stream, hubReqCh)
+			go hubWriter(c, stream, hubRspCh)
 
 			proxying := true
 
@@ -345,10 +482,16 @@ func main() {
 							// start a web client for each req
 							clientId += 1
 							clientsPending += 1
-							go webClient(clientId, req, srv, hubRspCh, cltEndCh)
+							if req.req.Header.Get(webswitch.HEADER_TUNNEL) != "" ||
+								strings.HasPrefix(srv, SCHEME_TCP+"://") {
+								go tunnelClient(clientId, req, srv, hubRspCh, cltEndCh)
+							} else {
+								go webClient(clientId, req, pools[req.req.Host], hubRspCh, cltEndCh)
+							}
 						} else {
 							// no need to start web client
 							log.Println("no server for", req.req.Host)
+							req.req.Body.Close()
 							hubRspCh <- webswitch.QuickResponse(http.StatusNotFound,
 								req.req)
 						}
@@ -0,0 +1,190 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scheme of sites served from local directories, e.g. "file:///srv/docs"
+const SCHEME_FILE = "file"
+
+// index files of directories by default
+var STATIC_INDEX = []string{"index.html", "index.htm"}
+
+// precompressed variants of files by encoding, best first
+var STATIC_ENCODINGS = [][2]string{{"br", ".br"}, {"gzip", ".gz"}}
+
+// StaticConfig holds settings of sites served from local directories
+type StaticConfig struct {
+	Index []string // index files of directories, STATIC_INDEX if empty
+	List  bool     // list directories without index files
+	// serve "name.br" or "name.gz" next to a file to visitors accepting them
+	Precompressed bool
+}
+
+// staticSite serves files under a directory, hidden ones excepted
+type staticSite struct {
+	root *os.Root
+	cfg  *StaticConfig
+}
+
+// open the directory to serve
+func new_static(dir string, cfg *StaticConfig) (*staticSite, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &StaticConfig{}
+	}
+	return &staticSite{root, cfg}, nil
+}
+
+// strong validator of the file
+func static_etag(fi fs.FileInfo, suffix string) string {
+	return `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 36) + "-" +
+		strconv.FormatInt(fi.Size(), 36) + suffix + `"`
+}
+
+// whether the visitor accepts the encoding
+func accepts(r *http.Request, enc string) bool {
+	for _, line := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(line, ",") {
+			fields := strings.Split(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(fields[0]), enc) {
+				continue
+			}
+			for _, p := range fields[1:] {
+				if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+					if q, _ := strconv.ParseFloat(v[2:], 64); q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (ss *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p := path.Clean("/" + r.URL.Path)
+	for _, seg := range strings.Split(p, "/") {
+		if strings.HasPrefix(seg, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	name := "." + p
+	fi, err := ss.root.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+			u := url.URL{Path: p + "/", RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		index := ss.cfg.Index
+		if len(index) == 0 {
+			index = STATIC_INDEX
+		}
+		for _, f := range index {
+			if ifi, err := ss.root.Stat(path.Join(name, f)); err == nil && !ifi.IsDir() {
+				ss.serve_file(w, r, path.Join(name, f), ifi)
+				return
+			}
+		}
+		if ss.cfg.List {
+			ss.list(w, r, name)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	ss.serve_file(w, r, name, fi)
+}
+
+// serve the file or its precompressed variant, with ranges and
+// conditional requests
+func (ss *staticSite) serve_file(w http.ResponseWriter, r *http.Request, name string, fi fs.FileInfo) {
+	h := w.Header()
+	file, suffix := name, ""
+	if ss.cfg.Precompressed {
+		h.Add("Vary", "Accept-Encoding")
+		for _, enc := range STATIC_ENCODINGS {
+			if !accepts(r, enc[0]) {
+				continue
+			}
+			if efi, err := ss.root.Stat(name + enc[1]); err == nil && !efi.IsDir() {
+				h.Set("Content-Encoding", enc[0])
+				file, suffix, fi = name+enc[1], enc[1], efi
+				break
+			}
+		}
+	}
+	f, err := ss.root.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	h.Set("ETag", static_etag(fi, suffix))
+	// the type of the original, as the variant only differs by encoding
+	http.ServeContent(w, r, path.Base(name), fi.ModTime(), f)
+}
+
+// list the directory
+func (ss *staticSite) list(w http.ResponseWriter, r *http.Request, name string) {
+	d, err := ss.root.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := d.ReadDir(-1)
+	d.Close()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	title := html.EscapeString(path.Clean(r.URL.Path))
+	fmt.Fprintf(w, "<!doctype html>\n<title>%s</title>\n<h1>%s</h1>\n<pre>\n", title, title)
+	for _, e := range entries {
+		n := e.Name()
+		if strings.HasPrefix(n, ".") {
+			continue
+		}
+		if e.IsDir() {
+			n += "/"
+		}
+		// "./" keeps names like "javascript:x" from being taken as schemes
+		href := (&url.URL{Path: "./" + n}).String()
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(n))
+	}
+	io.WriteString(w, "</pre>\n")
+}
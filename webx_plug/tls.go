@@ -0,0 +1,62 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLS versions by config names
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// BackendTLS holds settings to reach an "https" real host, like one with a
+// certificate of an internal CA or one asking for client certificates
+type BackendTLS struct {
+	CA         string // PEM file of CAs to verify the real host, system roots if empty
+	Cert       string // PEM file of the client certificate, if the real host asks
+	Key        string // PEM file of the client key
+	ServerName string // name to send as SNI and to verify, defaults to the URL host
+	MinVersion string // lowest TLS version, "1.0" to "1.3"
+	// skip verifying the real host at all, only for labs
+	InsecureSkipVerify bool
+}
+
+// build the TLS config
+func (bt *BackendTLS) config() (*tls.Config, error) {
+	tc := &tls.Config{ServerName: bt.ServerName, InsecureSkipVerify: bt.InsecureSkipVerify}
+	if bt.CA != "" {
+		pem, err := ioutil.ReadFile(bt.CA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no CA certs in " + bt.CA)
+		}
+	}
+	if bt.Cert != "" || bt.Key != "" {
+		crt, err := tls.LoadX509KeyPair(bt.Cert, bt.Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{crt}
+	}
+	if bt.MinVersion != "" {
+		v, ok := TLS_VERSIONS[bt.MinVersion]
+		if !ok {
+			return nil, errors.New("bad TLS version " + bt.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	return tc, nil
+}
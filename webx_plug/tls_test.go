@@ -0,0 +1,141 @@
+// Copyright 2015 The WebSwitch authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue a cert of the name signed by the parent, self signed if nil. the
+// cert and key are written as name.crt and name.key in dir.
+func test_cert(t *testing.T, dir, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signer_key := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signer_key = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pk := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	os.WriteFile(filepath.Join(dir, name+".crt"), crt, 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pk, 0600)
+	c, err := tls.X509KeyPair(crt, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Leaf, _ = x509.ParseCertificate(der)
+	return &c
+}
+
+func Test_backend_tls(t *testing.T) {
+	dir := t.TempDir()
+	ca := test_cert(t, dir, "ca", nil)
+	srv_crt := test_cert(t, dir, "www.test", ca)
+	test_cert(t, dir, "plug", ca)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	os.WriteFile(file("empty.pem"), []byte("no certs here"), 0600)
+
+	for _, c := range []struct {
+		bt *BackendTLS
+		ok bool
+	}{
+		{&BackendTLS{CA: file("empty.pem")}, false},
+		{&BackendTLS{CA: file("missing.pem")}, false},
+		{&BackendTLS{MinVersion: "1.4"}, false},
+		{&BackendTLS{Cert: file("plug.crt")}, false},
+		{&BackendTLS{CA: file("ca.crt"), MinVersion: "1.2"}, true},
+		{&BackendTLS{CA: file("ca.crt"), Cert: file("plug.crt"), Key: file("plug.key")}, true},
+	} {
+		if _, err := c.bt.config(); (err == nil) != c.ok {
+			t.Errorf("%+v: expected ok %v, got %v", c.bt, c.ok, err)
+		}
+	}
+
+	// a real host of the custom CA asking for client certs
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{*srv_crt},
+		ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, c := range []struct {
+		bt   *BackendTLS
+		body string
+	}{
+		{&BackendTLS{CA: file("ca.crt"), Cert: file("plug.crt"), Key: file("plug.key"),
+			ServerName: "www.test"}, "plug"},
+		// no client cert
+		{&BackendTLS{CA: file("ca.crt"), ServerName: "www.test"}, ""},
+		// system roots don't know the CA
+		{&BackendTLS{Cert: file("plug.crt"), Key: file("plug.key"), ServerName: "www.test"}, ""},
+		// the cert is not for the name
+		{&BackendTLS{CA: file("ca.crt"), Cert: file("plug.crt"), Key: file("plug.key"),
+			ServerName: "other.test"}, ""},
+	} {
+		sc := &SiteConfig{TLS: c.bt}
+		var err error
+		if sc.tls, err = c.bt.config(); err != nil {
+			t.Fatal(err)
+		}
+		be, err := new_pool("www.test", srv.URL, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := be.do(httptest.NewRequest("GET", "http://www.test/", nil), "1")
+		if c.body == "" {
+			if err == nil {
+				rsp.Body.Close()
+				t.Errorf("%+v: expected handshake error", c.bt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != c.body {
+			t.Error("expected client", c.body, "got", string(body))
+		}
+	}
+}
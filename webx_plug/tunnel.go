@@ -0,0 +1,69 @@
+// Copyright 2015 The Web Switch Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webx_plug
+
+import (
+	"github.com/yf13/webswitch"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// scheme of real hosts reached by raw TCP through tunnels, e.g. SSH or
+// database servers published as "tcp://localhost:22"
+const SCHEME_TCP = "tcp"
+
+// time to dial real hosts of tunnels
+const TUNNEL_DIAL_TIMEOUT = 10 * time.Second
+
+// The tunnel client routine. It dials the real host asked by a CONNECT
+// request of the hub, then connects a tunnel back to the hub and answers
+// the request. The tunnel lives on after the routine is done, so that
+// hub links can be redialed without waiting for tunnels.
+func tunnelClient(
+	id int,
+	req *HubRequest,
+	srv string,
+	rsp_ch chan<- *http.Response,
+	clt_done chan<- int,
+) {
+	// tell main loop I am done
+	defer func() { clt_done <- id }()
+
+	req.req.Body.Close()
+	reqId := webswitch.RequestId(req.req)
+	token := req.req.Header.Get(webswitch.HEADER_TUNNEL)
+	srvUrl, err := url.Parse(srv)
+	if req.req.Method != "CONNECT" || token == "" || err != nil || srvUrl.Scheme != SCHEME_TCP {
+		log.Printf("denied tunnel req#%s to %s", reqId, srv)
+		rsp_ch <- webswitch.QuickResponse(http.StatusBadRequest, req.req)
+		return
+	}
+	c, err := net.DialTimeout("tcp", srvUrl.Host, TUNNEL_DIAL_TIMEOUT)
+	if err != nil {
+		log.Printf("error dial tunnel req#%s: %v", reqId, err)
+		rsp_ch <- webswitch.QuickResponse(http.StatusBadGateway, req.req)
+		return
+	}
+	ws, _, err := hub_dialer().Dial(*fe_url+webswitch.HUB_TUNNEL_PATH,
+		http.Header{webswitch.HEADER_TUNNEL: {token}})
+	if err != nil {
+		log.Printf("error connect tunnel req#%s: %v", reqId, err)
+		c.Close()
+		rsp_ch <- webswitch.QuickResponse(http.StatusBadGateway, req.req)
+		return
+	}
+	rsp_ch <- webswitch.QuickResponse(http.StatusOK, req.req)
+	log.Printf("tunnel req#%s to %s for %s", reqId, srvUrl.Host,
+		req.req.Header.Get(webswitch.HEADER_FORWARD_FOR))
+	go func() {
+		if err := webswitch.Tunnel(ws, c); err != nil {
+			log.Printf("error tunnel req#%s: %v", reqId, err)
+		}
+		log.Printf("tunnel req#%s closed", reqId)
+	}()
+}